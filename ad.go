@@ -4,23 +4,30 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
-	"fmt"
+	"log"
 	"net/http"
 )
 
+// lifecycle of an ad
+const (
+	adStatusPendingReview = "pending_review"
+	adStatusActive        = "active"
+	adStatusPaused        = "paused"
+	adStatusArchived      = "archived"
+	// refused by a reviewer, see review.go
+	adStatusRejected = "rejected"
+)
+
 /*
 add an ad into ad table
 return:
 	error
 	nil
 */
-func insertAd(ad Ad) error {
-	db, err := sql.Open("mysql", mysqlDataSourceName)
-	if err != nil {
-		return errors.New("Failed to connect MySQL database")
-	}
-
-	insert, err := db.Query("INSERT INTO ad (bid, image_url, advertiser_id, ad_score) VALUES (?, ?, ?, ?)", ad.Bid, ad.ImageURL, ad.AdvertiserID, ad.AdScore)
+func (store *mysqlStore) InsertAd(ad Ad) error {
+	capImpressions, capWindow := frequencyCapColumns(ad.FrequencyCap)
+	insert, err := store.db.Query("INSERT INTO ad (bid, image_url, advertiser_id, ad_score, ad_group_id, status, billing_model, landing_url, freq_cap_impressions, freq_cap_window, targeting) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		ad.Bid, ad.ImageURL, ad.AdvertiserID, ad.AdScore, nullID(ad.AdGroupID), ad.Status, ad.BillingModel, ad.LandingURL, capImpressions, capWindow, targetingColumn(ad.Targeting))
 	if err != nil {
 		return errors.New("Failed to add into ad table")
 	}
@@ -31,10 +38,10 @@ func insertAd(ad Ad) error {
 
 /*
 HanldeFunction
-use "insertAd" to add an ad into ad table
+use "InsertAd" of the AdStore to add an ad into ad table
 */
-func handleFuncAddAd(w http.ResponseWriter, req *http.Request) {
-	fmt.Println("Received one ad insertion request")
+func (s *server) handleFuncAddAd(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received one ad insertion request")
 	w.Header().Set("Content-Type", "text/plain")
 
 	if req.Method != "POST" {
@@ -46,11 +53,52 @@ func handleFuncAddAd(w http.ResponseWriter, req *http.Request) {
 	var ad Ad
 	if err := decoder.Decode(&ad); err != nil {
 		http.Error(w, "Cannot decode ad's data from client", 400)
-		fmt.Println("Cannot decode ad's data from client.", err)
+		log.Println("Cannot decode ad's data from client.", err)
+		return
+	}
+	if ad.BillingModel == "" {
+		ad.BillingModel = billingCPC
+	}
+	if !validBillingModel(ad.BillingModel) {
+		http.Error(w, "Billing model must be cpc, cpm or cpa.", 400)
+		return
+	}
+	if ad.LandingURL != "" && !validLandingURL(ad.LandingURL) {
+		http.Error(w, "Landing url must be an absolute http or https url.", 400)
+		return
+	}
+	if !validFrequencyCap(ad.FrequencyCap) {
+		http.Error(w, "Frequency cap needs positive impressions and a window of at least 1s.", 400)
+		return
+	}
+	if err := ad.Targeting.normalize(); err != nil {
+		http.Error(w, err.Error()+".", 400)
 		return
 	}
+	// an ad in an ad group belongs to the advertiser of the group's campaign
+	if ad.AdGroupID != 0 {
+		campaign, err := s.campaignOfAdGroup(ad.AdGroupID)
+		if err != nil {
+			writeCampaignError(w, err)
+			return
+		}
+		if ad.AdvertiserID == 0 {
+			ad.AdvertiserID = campaign.AdvertiserID
+		}
+		if ad.AdvertiserID != campaign.AdvertiserID {
+			http.Error(w, "Ad group belongs to another advertiser.", 400)
+			return
+		}
+	}
+
+	// the adscore is learned from the ad's clicks (see adscore.go), a new ad starts at the prior
+	ad.AdScore = adScorePrior.priorCTR
+
+	// every new ad waits for review (/reviewAd) before it can serve
+	ad.Status = adStatusPendingReview
+
 	// insert ad into ad table
-	if err := insertAd(ad); err != nil {
+	if err := s.ads.InsertAd(ad); err != nil {
 		http.Error(w, "Failed to add advertisement data into ad table.", 400)
 		return
 	}
@@ -58,43 +106,95 @@ func handleFuncAddAd(w http.ResponseWriter, req *http.Request) {
 
 }
 
-func selectAllAdsByAdvertiserID(id int) ([]Ad, error) {
-	// connect to database
-	db, err := sql.Open("mysql", mysqlDataSourceName)
-	if err != nil {
-		return nil, errors.New("Failed to connect MySQL database")
-	}
+// columns of the ad table, in the order scanAds reads them
+const adColumns = "ad_id, bid, image_url, advertiser_id, ad_score, ad_group_id, status, billing_model, landing_url, freq_cap_impressions, freq_cap_window, targeting"
 
-	// select all ads with advertiser id and save them into a slice of type Ad
+/*
+convert the rows of "SELECT adColumns FROM ad" into type Ad
+*/
+func scanAds(result *sql.Rows) ([]Ad, error) {
 	var Ads []Ad
-	result, err := db.Query("SELECT * FROM ad WHERE advertiser_id = ?", id)
-	if err != nil {
-		return nil, errors.New("Failed to select ads by advertiser_id from MySQL database")
-	}
-	defer result.Close()
-
 	for result.Next() {
 		var ad Ad
 		// deal with possible Null values from database
 		// if null bid / score ==> 0
 		// if null imageuURL ==> ""
 		var nilURL []byte
-		var nilBid, nilAdScore sql.NullFloat64
-		err = result.Scan(&ad.AdID, &nilBid, &nilURL, &ad.AdvertiserID, &nilAdScore)
+		var nilBid sql.NullInt64
+		var nilAdScore sql.NullFloat64
+		var nilAdGroupID sql.NullInt64
+		var capImpressions int
+		var capWindow int64
+		var targeting sql.NullString
+		err := result.Scan(&ad.AdID, &nilBid, &nilURL, &ad.AdvertiserID, &nilAdScore, &nilAdGroupID, &ad.Status, &ad.BillingModel, &ad.LandingURL, &capImpressions, &capWindow, &targeting)
 		if err != nil {
 			return nil, errors.New("Failed to convert MySQL data into Ad type")
 		}
 		ad.ImageURL = string(nilURL)
-		ad.Bid = nilBid.Float64
+		ad.Bid = Money(nilBid.Int64)
 		ad.AdScore = nilAdScore.Float64
+		ad.AdGroupID = int(nilAdGroupID.Int64)
+		ad.FrequencyCap = frequencyCapFromColumns(capImpressions, capWindow)
+		if ad.Targeting, err = targetingFromColumn(targeting); err != nil {
+			return nil, errors.New("Failed to convert MySQL data into Ad type")
+		}
 		Ads = append(Ads, ad)
 	}
 	return Ads, nil
+}
+
+/*
+select one ad by ad_id
+return:
+	no such ad: "Ad not found"
+*/
+func (store *mysqlStore) SelectAd(adID int) (Ad, error) {
+	result, err := store.db.Query("SELECT "+adColumns+" FROM ad WHERE ad_id = ?", adID)
+	if err != nil {
+		return Ad{}, errors.New("Failed to select ad by ad_id from MySQL database")
+	}
+	defer result.Close()
 
+	ads, err := scanAds(result)
+	if err != nil {
+		return Ad{}, err
+	}
+	if len(ads) == 0 {
+		return Ad{}, errors.New("Ad not found")
+	}
+	return ads[0], nil
+}
+
+/*
+select all active ads from database
+convert each ad into type Ad
+return:
+	a slice of type Ad
+*/
+func (store *mysqlStore) SelectActiveAds() ([]Ad, error) {
+	// select all active ads and save them into a slice of type Ad
+	result, err := store.selectActiveAdsStmt.Query()
+	if err != nil {
+		return nil, errors.New("Failed to select all the ads from MySQL database")
+	}
+	defer result.Close()
+
+	return scanAds(result)
 }
 
-func handleFuncSearchAdsByAdvertiserID(w http.ResponseWriter, req *http.Request) {
-	fmt.Println("Received one ad insertion request")
+func (store *mysqlStore) SelectAdsByAdvertiserID(id int) ([]Ad, error) {
+	// select all ads with advertiser id and save them into a slice of type Ad
+	result, err := store.db.Query("SELECT "+adColumns+" FROM ad WHERE advertiser_id = ?", id)
+	if err != nil {
+		return nil, errors.New("Failed to select ads by advertiser_id from MySQL database")
+	}
+	defer result.Close()
+
+	return scanAds(result)
+}
+
+func (s *server) handleFuncSearchAdsByAdvertiserID(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received one ad insertion request")
 	w.Header().Set("Content-Type", "text/plain")
 
 	if req.Method != "POST" {
@@ -106,12 +206,12 @@ func handleFuncSearchAdsByAdvertiserID(w http.ResponseWriter, req *http.Request)
 	var ad Ad
 	if err := decoder.Decode(&ad); err != nil {
 		http.Error(w, "Cannot decode ad's data from client", 400)
-		fmt.Println("Cannot decode ad's data from client.", err)
+		log.Println("Cannot decode ad's data from client.", err)
 		return
 	}
 
 	// search all ads by advertiser id
-	allAdsByAdvertiserID, err := selectAllAdsByAdvertiserID(ad.AdvertiserID)
+	allAdsByAdvertiserID, err := s.ads.SelectAdsByAdvertiserID(ad.AdvertiserID)
 	if err != nil {
 		if err.Error() == "Failed to connect the database" {
 			http.Error(w, "Failed to connect the database.", 500)
@@ -127,35 +227,28 @@ func handleFuncSearchAdsByAdvertiserID(w http.ResponseWriter, req *http.Request)
 	allAdsByAdvertiserIDJSON, err := json.Marshal(allAdsByAdvertiserID)
 	if err != nil {
 		http.Error(w, "Failed to parse allAds into JSON format", 500)
-		fmt.Printf("Failed to parse allAds into JSON format %v.\n", err)
+		log.Printf("Failed to parse allAds into JSON format %v.\n", err)
 		return
 	}
 
 	w.Write(allAdsByAdvertiserIDJSON)
 }
 
-func deleteAd(ad Ad) error {
-	// connect to database
-	db, err := sql.Open("mysql", mysqlDataSourceName)
-	if err != nil {
-		return errors.New("Failed to connect MySQL database")
-	}
-	defer db.Close()
-
+func (store *mysqlStore) DeleteAd(adID int) error {
 	// delete ad
-	del, err := db.Prepare("DELETE FROM ad WHERE ad_id=?")
+	del, err := store.db.Prepare("DELETE FROM ad WHERE ad_id=?")
 	if err != nil {
 		return errors.New("Failed to delete ad")
 	}
-	del.Exec(ad.AdID)
+	del.Exec(adID)
 	defer del.Close()
 
 	return nil
 
 }
 
-func handleFuncDeleteAd(w http.ResponseWriter, req *http.Request) {
-	fmt.Println("Received one ad insertion request")
+func (s *server) handleFuncDeleteAd(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received one ad insertion request")
 	w.Header().Set("Content-Type", "text/plain")
 
 	if req.Method != "POST" {
@@ -167,12 +260,12 @@ func handleFuncDeleteAd(w http.ResponseWriter, req *http.Request) {
 	var ad Ad
 	if err := decoder.Decode(&ad); err != nil {
 		http.Error(w, "Cannot decode ad's data from client", 400)
-		fmt.Println("Cannot decode ad's data from client.", err)
+		log.Println("Cannot decode ad's data from client.", err)
 		return
 	}
 
 	// delete the ad
-	err := deleteAd(ad)
+	err := s.ads.DeleteAd(ad.AdID)
 	if err != nil {
 		if err.Error() == "Failed to connect the database" {
 			http.Error(w, "Failed to connect the database.", 500)
@@ -184,3 +277,90 @@ func handleFuncDeleteAd(w http.ResponseWriter, req *http.Request) {
 	w.Write([]byte("Successfully deleted an ad."))
 
 }
+
+/*
+move an ad from status "from" to "to" if it is still in "from"
+return:
+	moved: true, nil
+	status changed meanwhile: false, nil
+*/
+func (store *mysqlStore) SetAdStatus(adID int, from, to string) (bool, error) {
+	result, err := store.db.Exec("UPDATE ad SET status = ? WHERE ad_id = ? AND status = ?", to, adID, from)
+	if err != nil {
+		return false, errors.New("Failed to update ad status")
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.New("Failed to update ad status")
+	}
+	return n == 1, nil
+}
+
+/*
+allowed status changes
+	active <==> paused
+	active / paused / rejected ==> archived
+an ad leaves pending_review only through a review (/reviewAd), archived is final
+*/
+var adStatusTransitions = map[string][]string{
+	adStatusActive:   {adStatusPaused, adStatusArchived},
+	adStatusPaused:   {adStatusActive, adStatusArchived},
+	adStatusRejected: {adStatusArchived},
+}
+
+func canChangeAdStatus(from, to string) bool {
+	for _, allowed := range adStatusTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+HanldeFunction
+move an ad to the status in the request ({"ad_id": 1, "status": "paused"})
+only active ads take part in auctions
+*/
+func (s *server) handleFuncUpdateAdStatus(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received one ad status request")
+	w.Header().Set("Content-Type", "text/plain")
+
+	if req.Method != "POST" {
+		return
+	}
+
+	// decode the json format info into Ad type
+	decoder := json.NewDecoder(req.Body)
+	var request Ad
+	if err := decoder.Decode(&request); err != nil {
+		http.Error(w, "Cannot decode ad's data from client", 400)
+		log.Println("Cannot decode ad's data from client.", err)
+		return
+	}
+
+	ad, err := s.ads.SelectAd(request.AdID)
+	if err != nil {
+		if err.Error() == "Ad not found" {
+			http.Error(w, "Ad not found.", 404)
+		} else {
+			http.Error(w, err.Error()+".", 500)
+		}
+		return
+	}
+	if !canChangeAdStatus(ad.Status, request.Status) {
+		http.Error(w, "Cannot change ad status from "+ad.Status+" to "+request.Status+".", 400)
+		return
+	}
+
+	moved, err := s.ads.SetAdStatus(ad.AdID, ad.Status, request.Status)
+	if err != nil {
+		http.Error(w, err.Error()+".", 500)
+		return
+	}
+	if !moved {
+		http.Error(w, "Ad status changed meanwhile, try again.", 409)
+		return
+	}
+	w.Write([]byte("Ad status changed to " + request.Status))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+/*
+click-through rate estimate of an ad, smoothed toward a prior:
+	adscore = (clicks + priorCTR * priorWeight) / (impressions + priorWeight)
+a new ad starts at priorCTR and moves toward its observed ctr as impressions accumulate
+priorWeight is the number of impressions the prior is worth
+*/
+type adScoreModel struct {
+	priorCTR    float64
+	priorWeight float64
+}
+
+// model of the adscores, set with -score-prior-ctr and -score-prior-weight
+var adScorePrior = adScoreModel{priorCTR: 0.02, priorWeight: 100}
+
+func (m adScoreModel) score(stats AdStats) float64 {
+	impressions := float64(stats.Impressions)
+	// a click whose impression was never reported still counts as shown
+	if clicks := float64(stats.Clicks); clicks > impressions {
+		impressions = clicks
+	}
+	return (float64(stats.Clicks) + m.priorCTR*m.priorWeight) / (impressions + m.priorWeight)
+}
+
+/*
+recompute the adscore of every active ad from its impression and click history
+*/
+func (s *server) refreshAdScores() error {
+	ads, err := s.ads.SelectActiveAds()
+	if err != nil {
+		return err
+	}
+	stats, err := s.events.SelectAllAdStats()
+	if err != nil {
+		return err
+	}
+
+	scores := map[int]float64{}
+	for _, ad := range ads {
+		scores[ad.AdID] = adScorePrior.score(stats[ad.AdID])
+	}
+	if len(scores) == 0 {
+		return nil
+	}
+	return s.ads.UpdateAdScores(scores)
+}
+
+/*
+refresh the adscores now and then every "interval", until the process exits
+*/
+func (s *server) runAdScoreJob(interval time.Duration) {
+	for {
+		if err := s.refreshAdScores(); err != nil {
+			log.Println("Failed to refresh adscores:", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+/*
+set the adscore of every ad in "scores" (ad_id ==> adscore) inside one transaction
+*/
+func (store *mysqlStore) UpdateAdScores(scores map[int]float64) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return errors.New("Failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	update, err := tx.Prepare("UPDATE ad SET ad_score = ? WHERE ad_id = ?")
+	if err != nil {
+		return errors.New("Failed to update adscores")
+	}
+	defer update.Close()
+	for adID, score := range scores {
+		if _, err = update.Exec(score, adID); err != nil {
+			return errors.New("Failed to update adscores")
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errors.New("Failed to commit transaction")
+	}
+	return nil
+}
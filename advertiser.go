@@ -4,7 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
-	"fmt"
+	"log"
 	"net/http"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -38,15 +38,9 @@ return:
 	err
 	nil
 */
-func insertAdvertiser(advertiser Advertiser) error {
-	db, err := sql.Open("mysql", mysqlDataSourceName)
-	if err != nil {
-		return errors.New("Failed to connect to MySQL database")
-	}
-	defer db.Close()
-
+func (store *mysqlStore) InsertAdvertiser(advertiser Advertiser) error {
 	// check if the advertiser already exists
-	exists, err := checkAdvertiserExists(db, advertiser)
+	exists, err := checkAdvertiserExists(store.db, advertiser)
 	if err != nil {
 		return errors.New("Failed to select from advertiser table")
 	}
@@ -55,7 +49,7 @@ func insertAdvertiser(advertiser Advertiser) error {
 	}
 
 	// if not exist, insert the advertiser into advertiser table
-	insert, err := db.Query("INSERT INTO advertiser (name, budget) VALUES(?, ?)", advertiser.Name, advertiser.Budget)
+	insert, err := store.db.Query("INSERT INTO advertiser (name, budget, daily_budget, pacing) VALUES(?, ?, ?, ?)", advertiser.Name, advertiser.Budget, advertiser.DailyBudget, advertiser.Pacing)
 	if err != nil {
 		return errors.New("Failed to insert into advertiser table")
 	}
@@ -66,10 +60,10 @@ func insertAdvertiser(advertiser Advertiser) error {
 
 /*
 HanldeFunction
-use "insertAdvertiser" to add a row of an advertiser into advertiser table
+use "InsertAdvertiser" of the AdvertiserStore to add a row of an advertiser into advertiser table
 */
-func handleFuncAddAdvertiser(w http.ResponseWriter, req *http.Request) {
-	fmt.Println("Received one advertiser insertion request")
+func (s *server) handleFuncAddAdvertiser(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received one advertiser insertion request")
 	w.Header().Set("Content-Type", "text/plain")
 
 	if req.Method != "POST" {
@@ -81,11 +75,15 @@ func handleFuncAddAdvertiser(w http.ResponseWriter, req *http.Request) {
 	var advertiser Advertiser
 	if err := decoder.Decode(&advertiser); err != nil {
 		http.Error(w, "Cannot decode advertiser's data from client", 400)
-		fmt.Println("Cannot decode advertiser's data from client.", err)
+		log.Println("Cannot decode advertiser's data from client.", err)
+		return
+	}
+	if err := checkDailyBudget(advertiser.DailyBudget, &advertiser.Pacing); err != nil {
+		http.Error(w, err.Error()+".", 400)
 		return
 	}
 	// insert advertiser into advertiser table
-	if err := insertAdvertiser(advertiser); err != nil {
+	if err := s.advertisers.InsertAdvertiser(advertiser); err != nil {
 		if err.Error() == "Failed to connect MySQL database" {
 			http.Error(w, "Failed to connect MySQL database.", 500)
 		} else if err.Error() == "Failed to select from advertiser table" {
@@ -100,43 +98,131 @@ func handleFuncAddAdvertiser(w http.ResponseWriter, req *http.Request) {
 	w.Write([]byte("Advertiser added successfully"))
 
 }
-func addBudget(process AddBudgetProcess) error {
-	// connect the database
-	db, err := sql.Open("mysql", mysqlDataSourceName)
+/*
+add "amount" (negative for a debit) to the budget of an advertiser
+the budget row is locked, checked and written inside one transaction,
+so concurrent debits and top-ups never lose an update
+the change is recorded in the budget_transaction ledger in the same transaction
+adID is 0 when the change is not about an ad
+campaignID is 0 when the change is not about a campaign, else the campaign budget changes too
+a campaign_budget change moves the campaign budget only, the advertiser balance stays as it is
+return:
+	changed: true, nil
+	budget would go below zero: false, nil
+	other error: false, err
+*/
+func (store *mysqlStore) ChangeBudget(advertiserID int, campaignID int, amount Money, txType string, adID int) (bool, error) {
+	tx, err := store.db.Begin()
 	if err != nil {
-		return errors.New("Failed to connect the database")
+		return false, errors.New("Failed to start transaction")
 	}
-	defer db.Close()
+	defer tx.Rollback()
 
-	// select advertiser with advertiserID
-	sele, err := db.Query("SELECT budget FROM advertiser WHERE advertiser_id=(?)", process.AdvertiserID)
+	// lock the advertiser row until commit
+	var nilBudget sql.NullInt64
+	err = tx.Stmt(store.lockBudgetStmt).QueryRow(advertiserID).Scan(&nilBudget)
+	if err == sql.ErrNoRows {
+		return false, errors.New("Advertiser not found")
+	}
 	if err != nil {
-		return errors.New("Failed to select from advertiser table")
+		return false, errors.New("Failed to get old budget")
 	}
-	defer sele.Close()
 
-	// get old budget from selected result
-	var newBudget float64
-	for sele.Next() {
-		var nilBudget sql.NullFloat64
-		if err = sele.Scan(&nilBudget); err != nil {
-			return errors.New("Failed to get old budget")
+	// never drive the budget below zero
+	newBudget := Money(nilBudget.Int64)
+	if txType != transactionCampaignBudget {
+		newBudget += amount
+		if newBudget < 0 {
+			return false, nil
+		}
+		if _, err = tx.Stmt(store.updateBudgetStmt).Exec(newBudget, advertiserID); err != nil {
+			return false, errors.New("Failed to update budget")
 		}
-		newBudget = nilBudget.Float64 + process.AddBudget
 	}
 
-	// update old budget with new budget
-	update, err := db.Query("UPDATE advertiser SET budget=(?) WHERE advertiser_id=(?)", newBudget, process.AdvertiserID)
-	if err != nil {
-		return errors.New("Failed to update budget")
+	// same for the campaign budget
+	if campaignID != 0 {
+		var campaignBudget int64
+		err = tx.Stmt(store.lockCampaignBudgetStmt).QueryRow(campaignID).Scan(&campaignBudget)
+		if err == sql.ErrNoRows {
+			return false, errors.New("Campaign not found")
+		}
+		if err != nil {
+			return false, errors.New("Failed to get old budget")
+		}
+		newCampaignBudget := Money(campaignBudget) + amount
+		if newCampaignBudget < 0 {
+			return false, nil
+		}
+		if _, err = tx.Stmt(store.updateCampaignBudgetStmt).Exec(newCampaignBudget, campaignID); err != nil {
+			return false, errors.New("Failed to update budget")
+		}
+	}
+
+	// write the ledger entry
+	if _, err = tx.Stmt(store.insertLedgerStmt).Exec(advertiserID, txType, amount, nullID(adID), nullID(campaignID), newBudget); err != nil {
+		return false, errors.New("Failed to insert into budget_transaction table")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, errors.New("Failed to commit transaction")
+	}
+	return true, nil
+}
+
+/*
+response the client with the error of ChangeBudget
+*/
+func writeBudgetError(w http.ResponseWriter, err error) {
+	if err.Error() == "Failed to connect the database" {
+		http.Error(w, "Failed to connect the database.", 500)
+	} else if err.Error() == "Failed to start transaction" {
+		http.Error(w, "Failed to start transaction.", 500)
+	} else if err.Error() == "Advertiser not found" {
+		http.Error(w, "Advertiser not found.", 404)
+	} else if err.Error() == "Campaign not found" {
+		http.Error(w, "Campaign not found.", 404)
+	} else if err.Error() == "Failed to get old budget" {
+		http.Error(w, "Failed to get old budget.", 500)
+	} else if err.Error() == "Failed to update budget" {
+		http.Error(w, "Failed to update budget.", 500)
+	} else if err.Error() == "Failed to insert into budget_transaction table" {
+		http.Error(w, "Failed to insert into budget_transaction table.", 500)
+	} else if err.Error() == "Failed to commit transaction" {
+		http.Error(w, "Failed to commit transaction.", 500)
+	} else if err.Error() == "Insufficient budget" {
+		http.Error(w, "Insufficient budget.", 400)
+	} else if err.Error() == "Unknown transaction type" {
+		http.Error(w, "Unknown transaction type.", 400)
 	}
-	defer update.Close()
+}
 
+/*
+add budget to an advertiser inside one transaction
+"type" is top_up (default), refund or adjustment
+a negative "add_budget" may not take the budget below zero
+*/
+func addBudget(store AdvertiserStore, process AddBudgetProcess) error {
+	txType := process.Type
+	if txType == "" {
+		txType = transactionTopUp
+	}
+	if txType != transactionTopUp && txType != transactionRefund && txType != transactionAdjustment {
+		return errors.New("Unknown transaction type")
+	}
+
+	changed, err := store.ChangeBudget(process.AdvertiserID, 0, process.AddBudget, txType, process.AdID)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return errors.New("Insufficient budget")
+	}
 	return nil
 }
 
-func handleFuncAddBudget(w http.ResponseWriter, req *http.Request) {
-	fmt.Println("Received one add budget request")
+func (s *server) handleFuncAddBudget(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received one add budget request")
 	w.Header().Set("Content-Type", "text/plain")
 
 	if req.Method != "POST" {
@@ -148,47 +234,35 @@ func handleFuncAddBudget(w http.ResponseWriter, req *http.Request) {
 	var addBudgetProcess AddBudgetProcess
 	if err := decoder.Decode(&addBudgetProcess); err != nil {
 		http.Error(w, "Cannot decode addBudgetProcess data from client", 400)
-		fmt.Println("Cannot decode addBudgetProcess data from client.", err)
+		log.Println("Cannot decode addBudgetProcess data from client.", err)
 		return
 	}
 	// add budget
-	if err := addBudget(addBudgetProcess); err != nil {
-		if err.Error() == "Failed to connect the database" {
-			http.Error(w, "Failed to connect the database.", 500)
-		} else if err.Error() == "Failed to select from advertiser table" {
-			http.Error(w, "Failed to select from advertiser table.", 500)
-		} else if err.Error() == "Failed to get old budget" {
-			http.Error(w, "Failed to get old budget.", 500)
-		} else if err.Error() == "Failed to update budget" {
-			http.Error(w, "Failed to update budget.", 500)
-		}
+	if err := addBudget(s.advertisers, addBudgetProcess); err != nil {
+		writeBudgetError(w, err)
+		return
 	}
 	w.Write([]byte("Budget added successfully"))
 }
 
-func searchAdvertiser(searchName string) (Advertiser, error) {
+func (store *mysqlStore) SearchAdvertiser(searchName string) (Advertiser, error) {
 	var advertiser Advertiser
-	// connect to database
-	db, err := sql.Open("mysql", mysqlDataSourceName)
-	if err != nil {
-		return advertiser, errors.New("Failed to connect the database")
-	}
-	defer db.Close()
-
 	// select a row of advertiser infomation from table by name
 	var id int
 	var name string
-	var budget sql.NullFloat64
-	if err = db.QueryRow("SELECT advertiser_id, name, budget FROM advertiser WHERE name = ?", searchName).Scan(&id, &name, &budget); err != nil {
+	var budget sql.NullInt64
+	var dailyBudget int64
+	if err := store.db.QueryRow("SELECT advertiser_id, name, budget, daily_budget, pacing FROM advertiser WHERE name = ?", searchName).Scan(&id, &name, &budget, &dailyBudget, &advertiser.Pacing); err != nil {
 		return advertiser, errors.New("Failed to select from advertiser table")
 	}
 	// convert to Advertiser type
-	advertiser.AdvertiserID, advertiser.Name, advertiser.Budget = id, name, budget.Float64
+	advertiser.AdvertiserID, advertiser.Name, advertiser.Budget = id, name, Money(budget.Int64)
+	advertiser.DailyBudget = Money(dailyBudget)
 	return advertiser, nil
 }
 
-func handleFuncSearchAdvertiser(w http.ResponseWriter, req *http.Request) {
-	fmt.Println("Received one search advertiser request")
+func (s *server) handleFuncSearchAdvertiser(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received one search advertiser request")
 	w.Header().Set("Content-Type", "text/plain")
 
 	if req.Method != "POST" {
@@ -200,12 +274,12 @@ func handleFuncSearchAdvertiser(w http.ResponseWriter, req *http.Request) {
 	var advertiser Advertiser
 	if err := decoder.Decode(&advertiser); err != nil {
 		http.Error(w, "Cannot decode searchAdvertiserProcess data from client", 400)
-		fmt.Println("Cannot decode searchAdvertiserProcess data from client.", err)
+		log.Println("Cannot decode searchAdvertiserProcess data from client.", err)
 		return
 	}
 
 	// search advertiser by name
-	advertiser, err := searchAdvertiser(advertiser.Name)
+	advertiser, err := s.advertisers.SearchAdvertiser(advertiser.Name)
 	if err != nil {
 		if err.Error() == "Failed to connect the database" {
 			http.Error(w, "Failed to connect the database.", 500)
@@ -219,10 +293,34 @@ func handleFuncSearchAdvertiser(w http.ResponseWriter, req *http.Request) {
 	advertiserInfo, err := json.Marshal(advertiser)
 	if err != nil {
 		http.Error(w, "Failed to parse advertiser data into JSON format", 500)
-		fmt.Printf("Failed to parse advertiser data into JSON format %v.\n", err)
+		log.Printf("Failed to parse advertiser data into JSON format %v.\n", err)
 		return
 	}
 
 	w.Write(advertiserInfo)
 
 }
+
+/*
+budget left for every advertiser
+return:
+	advertiser_id ==> budget
+*/
+func (store *mysqlStore) SelectAdvertiserBudgets() (map[int]Money, error) {
+	result, err := store.selectBudgetsStmt.Query()
+	if err != nil {
+		return nil, errors.New("Failed to select from advertiser table")
+	}
+	defer result.Close()
+
+	budgets := map[int]Money{}
+	for result.Next() {
+		var id int
+		var nilBudget sql.NullInt64
+		if err = result.Scan(&id, &nilBudget); err != nil {
+			return nil, errors.New("Failed to get advertiser budget")
+		}
+		budgets[id] = Money(nilBudget.Int64)
+	}
+	return budgets, nil
+}
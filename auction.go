@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuctionWinner type
+type AuctionWinner struct {
+	AuctionID string `json:"auction_id"`
+	Position  int    `json:"position"`
+	Price     Money  `json:"price"`
+	Ad        Ad     `json:"ad"`
+	// signed token a click on the ad is reported with
+	ClickToken string `json:"click_token,omitempty"`
+	// signed tracking url of an ad with a landing url
+	ClickURL string `json:"click_url,omitempty"`
+}
+
+/*
+rank of an ad in the auction: its expected value per impression (eCPM / 1000)
+for a cpc ad this is bid * adscore
+*/
+func adRank(ad Ad) float64 {
+	return impressionValue(ad)
+}
+
+/*
+sort ads by rank, highest first
+ads with the same rank keep their database order
+*/
+func rankAds(ads []Ad) []Ad {
+	ranked := make([]Ad, len(ads))
+	copy(ranked, ads)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return adRank(ranked[i]) > adRank(ranked[j])
+	})
+	return ranked
+}
+
+// AuctionResult type
+type AuctionResult struct {
+	Mechanism string          `json:"mechanism"`
+	Winners   []AuctionWinner `json:"winners"`
+}
+
+// Auction ranks the candidate ads, fills up to "slots" positions and prices every winner
+// prices are per priced unit of the ad's billing model (click, 1000 impressions or conversion)
+// no winner pays less than "reserve" per unit
+type Auction interface {
+	Run(ads []Ad, slots int, reserve Money) AuctionResult
+}
+
+// available auction mechanisms, selected with ?mechanism= or the -auction flag
+var auctions = map[string]Auction{
+	"gsp":         secondPriceAuction{},
+	"first_price": firstPriceAuction{},
+	"vcg":         vcgAuction{positionDecay: 0.7},
+}
+
+// mechanism used when the request does not name one
+var defaultAuctionMechanism = "gsp"
+
+// global reserve price: the lowest price per click / mille / conversion any winner pays, set with -reserve
+var reservePrice = minBidIncrement
+
+// per-placement floors on the rank (value per impression), set with -floors
+var placementFloors = map[string]Money{}
+
+/*
+find the auction mechanism by name
+an empty name falls back to defaultAuctionMechanism
+*/
+func getAuction(name string) (Auction, error) {
+	if name == "" {
+		name = defaultAuctionMechanism
+	}
+	auction, ok := auctions[name]
+	if !ok {
+		return nil, errors.New("Unknown auction mechanism")
+	}
+	return auction, nil
+}
+
+/*
+parse placement floors written as "placement=floor,placement=floor"
+*/
+func parseFloors(s string) (map[string]Money, error) {
+	floors := map[string]Money{}
+	if s == "" {
+		return floors, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Placement floors must look like placement=floor")
+		}
+		floor, err := parseMoney(kv[1])
+		if err != nil || floor < 0 {
+			return nil, errors.New("Placement floor must be a non-negative number")
+		}
+		floors[strings.TrimSpace(kv[0])] = floor
+	}
+	return floors, nil
+}
+
+/*
+drop the ads that cannot take part in an auction for "placement":
+	rank (value per impression) below the placement floor
+	bid below the reserve price
+*/
+func eligibleAds(ads []Ad, placement string) []Ad {
+	floor := placementFloors[placement]
+	var eligible []Ad
+	for _, ad := range ads {
+		if adRank(ad) < floor.Float64() || ad.Bid < reservePrice {
+			continue
+		}
+		eligible = append(eligible, ad)
+	}
+	return eligible
+}
+
+/*
+no ad cleared the floors: answer 204 with an empty body
+*/
+func writeNoFill(w http.ResponseWriter) {
+	log.Println("No ad cleared the floor")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+run the auction over the ads whose advertisers (and campaigns) can pay for them
+an ad is dropped when the remaining budget of its advertiser or campaign (after paying
+for the higher ranked winners of the same advertiser / campaign) is below its price,
+and the auction is run again without it
+*/
+func runAffordableAuction(auction Auction, ads []Ad, slots int, budgets map[int]Money, campaignBudgets map[int]Money) []AuctionWinner {
+	// nobody can win without affording at least the reserve price
+	var candidates []Ad
+	for _, ad := range ads {
+		minimum := billedAmount(ad, reservePrice)
+		if budgets[ad.AdvertiserID] >= minimum && (ad.CampaignID == 0 || campaignBudgets[ad.CampaignID] >= minimum) {
+			candidates = append(candidates, ad)
+		}
+	}
+
+	for len(candidates) > 0 {
+		winners := auction.Run(candidates, slots, reservePrice).Winners
+
+		spent := map[int]Money{}
+		campaignSpent := map[int]Money{}
+		unaffordable := map[int]bool{}
+		for _, winner := range winners {
+			id, campaignID := winner.Ad.AdvertiserID, winner.Ad.CampaignID
+			cost := billedAmount(winner.Ad, winner.Price)
+			if budgets[id]-spent[id] < cost ||
+				(campaignID != 0 && campaignBudgets[campaignID]-campaignSpent[campaignID] < cost) {
+				unaffordable[winner.Ad.AdID] = true
+				continue
+			}
+			spent[id] += cost
+			campaignSpent[campaignID] += cost
+		}
+		if len(unaffordable) == 0 {
+			return winners
+		}
+
+		var rest []Ad
+		for _, ad := range candidates {
+			if !unaffordable[ad.AdID] {
+				rest = append(rest, ad)
+			}
+		}
+		candidates = rest
+	}
+	return nil
+}
+
+/*
+run one auction for the slots of the request, from the in-memory index and catalog:
+	retrieve the active ads whose targeting accepts the request context from the index
+	drop the ones their ad group / campaign keeps from serving
+	drop the ads whose campaign targeting rejects the request context
+	drop the ads the user has seen as often as the ad's or its campaign's frequency cap allows
+	drop the ads below the placement floor or the reserve price
+	run the auction over the ads whose advertisers and campaigns can pay for them
+	record the winners and their prices under a new auction id
+	sign a click url for every winner with a landing url
+nothing is charged here: a winner pays when the event of its billing model arrives (see chargeWinner)
+return:
+	served winners, nil (no winner: no fill)
+	err
+*/
+func (s *server) runAuction(auction Auction, request AuctionRequest) ([]AuctionWinner, error) {
+	// from here on, the work is proportional to the ads matching the request, not to the catalog
+	allAds := s.index.candidates(request.Context)
+	groups, campaigns := s.catalog.hierarchy()
+
+	now := time.Now()
+	candidates := applyHierarchy(allAds, groups, campaigns, request.Placement, now)
+	candidates = filterTargeting(candidates, campaigns, request.Context)
+	campaignCaps := map[int]*FrequencyCap{}
+	for _, ad := range candidates {
+		if ad.CampaignID != 0 {
+			campaignCaps[ad.CampaignID] = campaigns[ad.CampaignID].FrequencyCap
+		}
+	}
+	candidates = eligibleAds(s.frequency.filter(candidates, request.UserID, campaignCaps, now), request.Placement)
+	// advertisers and campaigns spending ahead of their daily pacing sit some auctions out
+	pacing := s.catalog.pacing(candidates, now)
+	candidates = pacing.throttle(candidates)
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	// only advertisers and campaigns with enough budget (and daily budget) left can win
+	budgets, campaignBudgets := s.catalog.budgetsOf(candidates)
+	pacing.capBudgets(budgets, campaignBudgets)
+	served := runAffordableAuction(auction, candidates, request.Slots, budgets, campaignBudgets)
+	if len(served) == 0 {
+		return nil, nil
+	}
+
+	// events on the served ads refer to this auction
+	auctionID, err := newAuctionID()
+	if err != nil {
+		return nil, err
+	}
+	for i := range served {
+		s.frequency.recordServed(request.UserID, served[i].Ad, campaignCaps[served[i].Ad.CampaignID], now)
+		served[i].AuctionID = auctionID
+		served[i].ClickToken = clickToken(auctionID, served[i].Ad.AdID, now.Add(clickTTL))
+		if served[i].Ad.LandingURL != "" {
+			served[i].ClickURL = clickURL(served[i].ClickToken)
+		}
+	}
+	// inserted in the store by the spend writer, not on the auction's path
+	if err = s.spend.recordAuction(auctionID, served); err != nil {
+		return nil, err
+	}
+	return served, nil
+}
+
+/*
+response the client with the error of runAuction
+*/
+func writeAuctionError(w http.ResponseWriter, err error) {
+	if err.Error() == "Failed to connect the database" {
+		http.Error(w, "Failed to connect the database.", 500)
+	} else if err.Error() == "Failed to select all the ads from MySQL database" {
+		http.Error(w, "Failed to select all the ads from MySQL database.", 500)
+	} else if err.Error() == "Failed to convert MySQL data into Ad type" {
+		http.Error(w, "Failed to convert MySQL data into Ad type.", 500)
+	} else if err.Error() == "Failed to select from advertiser table" {
+		http.Error(w, "Failed to select from advertiser table.", 500)
+	} else if err.Error() == "Failed to get advertiser budget" {
+		http.Error(w, "Failed to get advertiser budget.", 500)
+	} else if err.Error() == "Failed to select from campaign table" || err.Error() == "Failed to select from ad_group table" ||
+		err.Error() == "Failed to convert MySQL data into Campaign type" || err.Error() == "Failed to convert MySQL data into AdGroup type" ||
+		err.Error() == "Failed to generate auction id" || err.Error() == "Failed to write spend journal" {
+		http.Error(w, err.Error()+".", 500)
+	} else {
+		writeBudgetError(w, err)
+	}
+}
+
+/*
+the top "slots" ranked ads
+*/
+func topAds(ads []Ad, slots int) []Ad {
+	ranked := rankAds(ads)
+	if slots > len(ranked) {
+		slots = len(ranked)
+	}
+	return ranked[:slots]
+}
+
+/*
+generalized second-price auction
+each winner pays the lowest price per unit that still keeps its position:
+	price = max(rank(next) / unitsPerImpression(winner) + 0.01, reserve)
+for cpc ads: max(next.Bid * next.AdScore / winner.AdScore + 0.01, reserve)
+capped at the winner's own bid
+the last ranked ad (no one below it) pays the reserve
+*/
+type secondPriceAuction struct{}
+
+func (secondPriceAuction) Run(ads []Ad, slots int, reserve Money) AuctionResult {
+	ranked := rankAds(ads)
+	result := AuctionResult{Mechanism: "gsp"}
+	for i, ad := range topAds(ranked, slots) {
+		price := reserve
+		if i+1 < len(ranked) {
+			if p, ok := unitPrice(ad, adRank(ranked[i+1])); ok {
+				price = maxMoney(p+minBidIncrement, reserve)
+			}
+		}
+		// a tie with the next ad never makes a winner pay more than its bid
+		if price > ad.Bid {
+			price = maxMoney(ad.Bid, reserve)
+		}
+		result.Winners = append(result.Winners, AuctionWinner{Position: i + 1, Price: price, Ad: ad})
+	}
+	return result
+}
+
+/*
+first-price auction
+each winner pays its own bid
+*/
+type firstPriceAuction struct{}
+
+func (firstPriceAuction) Run(ads []Ad, slots int, reserve Money) AuctionResult {
+	result := AuctionResult{Mechanism: "first_price"}
+	for i, ad := range topAds(ads, slots) {
+		result.Winners = append(result.Winners, AuctionWinner{Position: i + 1, Price: maxMoney(ad.Bid, reserve), Ad: ad})
+	}
+	return result
+}
+
+/*
+vcg auction for ad positions
+position k (0 based) is clicked positionDecay^k as often as the first one
+each winner pays, per priced unit, the value the ads below it lose by not moving up one position:
+	price_i = sum over j > i of (ctr(j-1) - ctr(j)) * rank_j / (ctr(i) * unitsPerImpression_i)
+ads ranked below the last slot count with ctr = 0
+no winner pays less than the reserve
+*/
+type vcgAuction struct {
+	positionDecay float64
+}
+
+func (a vcgAuction) ctr(position, slots int) float64 {
+	if position >= slots {
+		return 0
+	}
+	return math.Pow(a.positionDecay, float64(position))
+}
+
+func (a vcgAuction) Run(ads []Ad, slots int, reserve Money) AuctionResult {
+	ranked := rankAds(ads)
+	result := AuctionResult{Mechanism: "vcg"}
+	for i, ad := range topAds(ranked, slots) {
+		var externality float64
+		for j := i + 1; j < len(ranked) && j <= slots; j++ {
+			externality += (a.ctr(j-1, slots) - a.ctr(j, slots)) * adRank(ranked[j])
+		}
+		price := reserve
+		if p, ok := unitPrice(ad, externality/a.ctr(i, slots)); ok {
+			price = maxMoney(p, reserve)
+		}
+		result.Winners = append(result.Winners, AuctionWinner{Position: i + 1, Price: price, Ad: ad})
+	}
+	return result
+}
+
+/*
+rank all ads and fill "slots" positions (query parameter, default 1)
+only ads clearing the floor of ?placement= and the reserve price take part
+ads whose ad group / campaign is paused, out of schedule or not targeting the placement are skipped
+ads ?user_id= has seen as often as their frequency caps allow are skipped
+ads whose targeting rejects the request context (?geo= &device= &lang= &keywords= &category= &hour=) are skipped
+ads whose advertisers or campaigns cannot pay their price are skipped
+price the winners with the auction named by ?mechanism= (default: defaultAuctionMechanism)
+every winner is charged its price on the first event of its billing model
+response the client with the ordered winners, or 204 when no ad clears the floor
+*/
+func (s *server) handleFuncChooseAds(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received one request for choosing ads")
+	w.Header().Set("Content-Type", "text/plain")
+
+	if req.Method != "GET" {
+		return
+	}
+
+	// number of ad slots on the page
+	slots := 1
+	if s := req.URL.Query().Get("slots"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, "slots must be a positive integer.", 400)
+			return
+		}
+		slots = n
+	}
+
+	auction, err := getAuction(req.URL.Query().Get("mechanism"))
+	if err != nil {
+		http.Error(w, "Unknown auction mechanism.", 400)
+		return
+	}
+
+	request, err := parseAuctionRequest(req.URL.Query(), slots, time.Now())
+	if err != nil {
+		http.Error(w, err.Error()+".", 400)
+		return
+	}
+
+	winners, err := s.runAuction(auction, request)
+	if err != nil {
+		writeAuctionError(w, err)
+		return
+	}
+	if len(winners) == 0 {
+		writeNoFill(w)
+		return
+	}
+
+	// convert winners into Json format
+	winnersJSON, err := json.Marshal(winners)
+	if err != nil {
+		http.Error(w, "Failed to parse winners into JSON format", 500)
+		log.Printf("Failed to parse winners into JSON format %v.\n", err)
+		return
+	}
+
+	w.Write(winnersJSON)
+}
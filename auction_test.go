@@ -0,0 +1,105 @@
+package main
+
+import "testing"
+
+// ad_id and price of a winner
+type pricedAd struct {
+	adID  int
+	price Money
+}
+
+func winnerPrices(winners []AuctionWinner) []pricedAd {
+	var prices []pricedAd
+	for _, w := range winners {
+		prices = append(prices, pricedAd{w.Ad.AdID, w.Price})
+	}
+	return prices
+}
+
+func samePrices(a, b []pricedAd) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// three cpc ads ranked 1.0, 0.5 and 0.1 per impression
+func testAds() []Ad {
+	return []Ad{
+		{AdID: 1, AdvertiserID: 1, Bid: 2 * microsPerUnit, AdScore: 0.5, BillingModel: billingCPC},
+		{AdID: 2, AdvertiserID: 2, Bid: 1 * microsPerUnit, AdScore: 0.5, BillingModel: billingCPC},
+		{AdID: 3, AdvertiserID: 3, Bid: 1 * microsPerUnit, AdScore: 0.1, BillingModel: billingCPC},
+	}
+}
+
+func TestAuctionPricing(t *testing.T) {
+	tied := []Ad{
+		{AdID: 1, AdvertiserID: 1, Bid: 1 * microsPerUnit, AdScore: 0.5, BillingModel: billingCPC},
+		{AdID: 2, AdvertiserID: 2, Bid: 1 * microsPerUnit, AdScore: 0.5, BillingModel: billingCPC},
+	}
+	tests := []struct {
+		name    string
+		auction Auction
+		ads     []Ad
+		slots   int
+		want    []pricedAd
+	}{
+		// next rank / own adscore + 0.01, the last one pays the reserve
+		{"gsp", secondPriceAuction{}, testAds(), 2, []pricedAd{{1, 1010000}, {2, 210000}}},
+		{"gsp one slot", secondPriceAuction{}, testAds(), 1, []pricedAd{{1, 1010000}}},
+		{"gsp more slots than ads", secondPriceAuction{}, testAds(), 5, []pricedAd{{1, 1010000}, {2, 210000}, {3, 10000}}},
+		{"gsp tie pays its bid", secondPriceAuction{}, tied, 1, []pricedAd{{1, 1000000}}},
+		{"gsp single ad", secondPriceAuction{}, testAds()[:1], 1, []pricedAd{{1, 10000}}},
+		{"first price", firstPriceAuction{}, testAds(), 2, []pricedAd{{1, 2000000}, {2, 1000000}}},
+		// ctr 1, 0.7, 0: ad 1 pays (0.3 * 0.5 + 0.7 * 0.1) / 0.5, ad 2 pays 0.7 * 0.1 / 0.7 / 0.5
+		{"vcg", vcgAuction{positionDecay: 0.7}, testAds(), 2, []pricedAd{{1, 440000}, {2, 200000}}},
+		{"vcg single ad", vcgAuction{positionDecay: 0.7}, testAds()[:1], 1, []pricedAd{{1, 10000}}},
+	}
+	for _, tt := range tests {
+		got := winnerPrices(tt.auction.Run(tt.ads, tt.slots, minBidIncrement).Winners)
+		if !samePrices(got, tt.want) {
+			t.Errorf("%s: winners = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRunAffordableAuction(t *testing.T) {
+	plenty := Money(100 * microsPerUnit)
+	sameAdvertiser := testAds()
+	sameAdvertiser[1].AdvertiserID = 1
+	inCampaign := testAds()
+	inCampaign[0].CampaignID = 7
+
+	tests := []struct {
+		name            string
+		ads             []Ad
+		budgets         map[int]Money
+		campaignBudgets map[int]Money
+		want            []pricedAd
+	}{
+		{"every advertiser can pay", testAds(), map[int]Money{1: plenty, 2: plenty, 3: plenty}, nil,
+			[]pricedAd{{1, 1010000}, {2, 210000}}},
+		// ad 1 cannot pay 1.01: the auction is run again without it
+		{"budget below the price", testAds(), map[int]Money{1: 500000, 2: plenty, 3: plenty}, nil,
+			[]pricedAd{{2, 210000}, {3, 10000}}},
+		{"budget below the reserve", testAds(), map[int]Money{1: 5000, 2: plenty, 3: plenty}, nil,
+			[]pricedAd{{2, 210000}, {3, 10000}}},
+		// 1.01 + 0.21 is more than 1.10: the lower ranked ad of the advertiser goes
+		{"advertiser pays for both its winners", sameAdvertiser, map[int]Money{1: 1100000, 3: plenty}, nil,
+			[]pricedAd{{1, 210000}, {3, 10000}}},
+		{"campaign budget below the price", inCampaign, map[int]Money{1: plenty, 2: plenty, 3: plenty}, map[int]Money{7: 500000},
+			[]pricedAd{{2, 210000}, {3, 10000}}},
+		{"nobody can pay", testAds(), map[int]Money{}, nil, nil},
+	}
+	for _, tt := range tests {
+		got := winnerPrices(runAffordableAuction(secondPriceAuction{}, tt.ads, 2, tt.budgets, tt.campaignBudgets))
+		if !samePrices(got, tt.want) {
+			t.Errorf("%s: winners = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+// billing models of an ad: the event its advertiser pays for
+const (
+	// cost per click: the bid is the price of a click
+	billingCPC = "cpc"
+	// cost per mille: the bid is the price of 1000 impressions
+	billingCPM = "cpm"
+	// cost per action: the bid is the price of a conversion
+	billingCPA = "cpa"
+)
+
+// share of the clicks on a cpa ad expected to convert, set with -cpa-conversion-rate
+var conversionRate = 0.05
+
+func validBillingModel(model string) bool {
+	return model == billingCPC || model == billingCPM || model == billingCPA
+}
+
+/*
+the event that charges an ad of "model": impression, click or conversion
+*/
+func billingEvent(model string) string {
+	switch model {
+	case billingCPM:
+		return eventImpression
+	case billingCPA:
+		return eventConversion
+	default:
+		return eventClick
+	}
+}
+
+/*
+how many priced units (clicks, 1000 impressions or conversions) one impression of the ad is expected to bring:
+	cpc: adscore (the click-through rate estimate)
+	cpm: 1 / 1000
+	cpa: adscore * conversionRate
+*/
+func unitsPerImpression(ad Ad) float64 {
+	switch ad.BillingModel {
+	case billingCPM:
+		return 1.0 / 1000
+	case billingCPA:
+		return ad.AdScore * conversionRate
+	default:
+		return ad.AdScore
+	}
+}
+
+/*
+expected value of one impression of the ad to its advertiser, in units: bid * unitsPerImpression
+eCPM is 1000 times this value, every billing model is ranked on it
+*/
+func impressionValue(ad Ad) float64 {
+	return ad.Bid.Float64() * unitsPerImpression(ad)
+}
+
+/*
+convert a price per impression into the price of one priced unit of the ad
+return:
+	the ad never brings a priced unit: false
+*/
+func unitPrice(ad Ad, perImpression float64) (Money, bool) {
+	units := unitsPerImpression(ad)
+	if units <= 0 {
+		return 0, false
+	}
+	return moneyFromFloat(perImpression / units), true
+}
+
+/*
+amount charged at one billing event of an ad priced "price"
+a cpm price covers 1000 impressions, each impression pays a thousandth of it
+*/
+func billedAmount(ad Ad, price Money) Money {
+	if ad.BillingModel == billingCPM {
+		return moneyFromFloat(price.Float64() / 1000)
+	}
+	return price
+}
@@ -0,0 +1,694 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// columns of the campaign table, in the order scanCampaigns reads them
+const campaignColumns = "campaign_id, advertiser_id, name, budget, start_time, end_time, placements, paused, freq_cap_impressions, freq_cap_window, targeting, daily_budget, pacing"
+
+// columns of the ad_group table, in the order scanAdGroups reads them
+const adGroupColumns = "ad_group_id, campaign_id, name, default_bid, paused"
+
+/*
+is the campaign serving at time "now":
+not paused and inside its schedule (a missing start / end leaves that side open)
+*/
+func (c Campaign) running(now time.Time) bool {
+	if c.Paused {
+		return false
+	}
+	if c.StartTime != nil && now.Before(*c.StartTime) {
+		return false
+	}
+	if c.EndTime != nil && !now.Before(*c.EndTime) {
+		return false
+	}
+	return true
+}
+
+/*
+does the campaign target "placement"
+no placements: every placement
+*/
+func (c Campaign) targetsPlacement(placement string) bool {
+	if len(c.Placements) == 0 {
+		return true
+	}
+	for _, p := range c.Placements {
+		if p == placement {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+resolve the ads against their ad groups and campaigns for an auction at "now" on "placement"
+an ad without ad group serves on its own as before
+an ad in an ad group serves only when:
+	the ad group and its campaign are not paused
+	the campaign is inside its schedule and targets the placement
+it bids the default bid of its ad group when it has no bid of its own,
+and carries the campaign id so the campaign budget is charged as well
+*/
+func applyHierarchy(ads []Ad, groupByID map[int]AdGroup, campaignByID map[int]Campaign, placement string, now time.Time) []Ad {
+	var servable []Ad
+	for _, ad := range ads {
+		if ad.AdGroupID == 0 {
+			servable = append(servable, ad)
+			continue
+		}
+		group, ok := groupByID[ad.AdGroupID]
+		if !ok || group.Paused {
+			continue
+		}
+		campaign, ok := campaignByID[group.CampaignID]
+		if !ok || !campaign.running(now) || !campaign.targetsPlacement(placement) {
+			continue
+		}
+		if ad.Bid == 0 {
+			ad.Bid = group.DefaultBid
+		}
+		ad.CampaignID = campaign.CampaignID
+		servable = append(servable, ad)
+	}
+	return servable
+}
+
+/*
+the campaign an ad group belongs to
+*/
+func (s *server) campaignOfAdGroup(adGroupID int) (Campaign, error) {
+	group, err := s.campaigns.SelectAdGroup(adGroupID)
+	if err != nil {
+		return Campaign{}, err
+	}
+	return s.campaigns.SelectCampaign(group.CampaignID)
+}
+
+// NULL for a 0 id
+func nullID(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+}
+
+/*
+convert the rows of "SELECT campaignColumns FROM campaign" into type Campaign
+*/
+func scanCampaigns(result *sql.Rows) ([]Campaign, error) {
+	var campaigns []Campaign
+	for result.Next() {
+		var c Campaign
+		var nilBudget sql.NullInt64
+		var placements string
+		var capImpressions int
+		var capWindow int64
+		var targeting sql.NullString
+		var dailyBudget int64
+		if err := result.Scan(&c.CampaignID, &c.AdvertiserID, &c.Name, &nilBudget, &c.StartTime, &c.EndTime, &placements, &c.Paused, &capImpressions, &capWindow, &targeting, &dailyBudget, &c.Pacing); err != nil {
+			return nil, errors.New("Failed to convert MySQL data into Campaign type")
+		}
+		c.Budget = Money(nilBudget.Int64)
+		c.DailyBudget = Money(dailyBudget)
+		c.FrequencyCap = frequencyCapFromColumns(capImpressions, capWindow)
+		var err error
+		if c.Targeting, err = targetingFromColumn(targeting); err != nil {
+			return nil, errors.New("Failed to convert MySQL data into Campaign type")
+		}
+		if placements != "" {
+			c.Placements = strings.Split(placements, ",")
+		}
+		campaigns = append(campaigns, c)
+	}
+	return campaigns, nil
+}
+
+/*
+convert the rows of "SELECT adGroupColumns FROM ad_group" into type AdGroup
+*/
+func scanAdGroups(result *sql.Rows) ([]AdGroup, error) {
+	var groups []AdGroup
+	for result.Next() {
+		var g AdGroup
+		var nilDefaultBid sql.NullInt64
+		if err := result.Scan(&g.AdGroupID, &g.CampaignID, &g.Name, &nilDefaultBid, &g.Paused); err != nil {
+			return nil, errors.New("Failed to convert MySQL data into AdGroup type")
+		}
+		g.DefaultBid = Money(nilDefaultBid.Int64)
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+func (store *mysqlStore) InsertCampaign(c Campaign) (int, error) {
+	capImpressions, capWindow := frequencyCapColumns(c.FrequencyCap)
+	result, err := store.db.Exec("INSERT INTO campaign (advertiser_id, name, budget, start_time, end_time, placements, paused, freq_cap_impressions, freq_cap_window, targeting, daily_budget, pacing) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		c.AdvertiserID, c.Name, c.Budget, c.StartTime, c.EndTime, strings.Join(c.Placements, ","), c.Paused, capImpressions, capWindow, targetingColumn(c.Targeting), c.DailyBudget, c.Pacing)
+	if err != nil {
+		return 0, errors.New("Failed to insert into campaign table")
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, errors.New("Failed to insert into campaign table")
+	}
+	return int(id), nil
+}
+
+func (store *mysqlStore) UpdateCampaign(c Campaign) error {
+	capImpressions, capWindow := frequencyCapColumns(c.FrequencyCap)
+	// the budget changes through ChangeBudget only, never overwritten here
+	result, err := store.db.Exec("UPDATE campaign SET name = ?, start_time = ?, end_time = ?, placements = ?, paused = ?, freq_cap_impressions = ?, freq_cap_window = ?, targeting = ?, daily_budget = ?, pacing = ? WHERE campaign_id = ?",
+		c.Name, c.StartTime, c.EndTime, strings.Join(c.Placements, ","), c.Paused, capImpressions, capWindow, targetingColumn(c.Targeting), c.DailyBudget, c.Pacing, c.CampaignID)
+	if err != nil {
+		return errors.New("Failed to update campaign")
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		// MySQL counts changed rows: make sure the campaign exists
+		if _, err := store.SelectCampaign(c.CampaignID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *mysqlStore) DeleteCampaign(campaignID int) error {
+	// fails while the campaign still has ad groups (foreign key)
+	if _, err := store.db.Exec("DELETE FROM campaign WHERE campaign_id = ?", campaignID); err != nil {
+		return errors.New("Failed to delete campaign")
+	}
+	return nil
+}
+
+func (store *mysqlStore) SelectCampaign(campaignID int) (Campaign, error) {
+	result, err := store.db.Query("SELECT "+campaignColumns+" FROM campaign WHERE campaign_id = ?", campaignID)
+	if err != nil {
+		return Campaign{}, errors.New("Failed to select from campaign table")
+	}
+	defer result.Close()
+
+	campaigns, err := scanCampaigns(result)
+	if err != nil {
+		return Campaign{}, err
+	}
+	if len(campaigns) == 0 {
+		return Campaign{}, errors.New("Campaign not found")
+	}
+	return campaigns[0], nil
+}
+
+func (store *mysqlStore) SelectCampaigns(advertiserID int) ([]Campaign, error) {
+	var result *sql.Rows
+	var err error
+	if advertiserID == 0 {
+		result, err = store.selectCampaignsStmt.Query()
+	} else {
+		result, err = store.db.Query("SELECT "+campaignColumns+" FROM campaign WHERE advertiser_id = ?", advertiserID)
+	}
+	if err != nil {
+		return nil, errors.New("Failed to select from campaign table")
+	}
+	defer result.Close()
+
+	return scanCampaigns(result)
+}
+
+func (store *mysqlStore) InsertAdGroup(g AdGroup) (int, error) {
+	result, err := store.db.Exec("INSERT INTO ad_group (campaign_id, name, default_bid, paused) VALUES (?, ?, ?, ?)",
+		g.CampaignID, g.Name, g.DefaultBid, g.Paused)
+	if err != nil {
+		return 0, errors.New("Failed to insert into ad_group table")
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, errors.New("Failed to insert into ad_group table")
+	}
+	return int(id), nil
+}
+
+func (store *mysqlStore) UpdateAdGroup(g AdGroup) error {
+	result, err := store.db.Exec("UPDATE ad_group SET name = ?, default_bid = ?, paused = ? WHERE ad_group_id = ?",
+		g.Name, g.DefaultBid, g.Paused, g.AdGroupID)
+	if err != nil {
+		return errors.New("Failed to update ad group")
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		if _, err := store.SelectAdGroup(g.AdGroupID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *mysqlStore) DeleteAdGroup(adGroupID int) error {
+	// fails while the ad group still has ads (foreign key)
+	if _, err := store.db.Exec("DELETE FROM ad_group WHERE ad_group_id = ?", adGroupID); err != nil {
+		return errors.New("Failed to delete ad group")
+	}
+	return nil
+}
+
+func (store *mysqlStore) SelectAdGroup(adGroupID int) (AdGroup, error) {
+	result, err := store.db.Query("SELECT "+adGroupColumns+" FROM ad_group WHERE ad_group_id = ?", adGroupID)
+	if err != nil {
+		return AdGroup{}, errors.New("Failed to select from ad_group table")
+	}
+	defer result.Close()
+
+	groups, err := scanAdGroups(result)
+	if err != nil {
+		return AdGroup{}, err
+	}
+	if len(groups) == 0 {
+		return AdGroup{}, errors.New("Ad group not found")
+	}
+	return groups[0], nil
+}
+
+func (store *mysqlStore) SelectAdGroups(campaignID int) ([]AdGroup, error) {
+	var result *sql.Rows
+	var err error
+	if campaignID == 0 {
+		result, err = store.selectAdGroupsStmt.Query()
+	} else {
+		result, err = store.db.Query("SELECT "+adGroupColumns+" FROM ad_group WHERE campaign_id = ?", campaignID)
+	}
+	if err != nil {
+		return nil, errors.New("Failed to select from ad_group table")
+	}
+	defer result.Close()
+
+	return scanAdGroups(result)
+}
+
+/*
+response the client with the error of a CampaignStore method
+*/
+func writeCampaignError(w http.ResponseWriter, err error) {
+	switch err.Error() {
+	case "Campaign not found", "Ad group not found":
+		http.Error(w, err.Error()+".", 404)
+	case "Failed to delete campaign", "Failed to delete ad group":
+		// usually still has ad groups / ads
+		http.Error(w, err.Error()+", remove what it contains first.", 400)
+	default:
+		http.Error(w, err.Error()+".", 500)
+	}
+}
+
+/*
+write "v" as JSON
+*/
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Failed to parse data into JSON format", 500)
+		log.Printf("Failed to parse data into JSON format %v.\n", err)
+		return
+	}
+	w.Write(content)
+}
+
+/*
+HanldeFunction
+add a campaign, response the client with the stored campaign
+*/
+func (s *server) handleFuncAddCampaign(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received one campaign insertion request")
+	w.Header().Set("Content-Type", "text/plain")
+
+	if req.Method != "POST" {
+		return
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	var campaign Campaign
+	if err := decoder.Decode(&campaign); err != nil {
+		http.Error(w, "Cannot decode campaign's data from client", 400)
+		log.Println("Cannot decode campaign's data from client.", err)
+		return
+	}
+	if campaign.AdvertiserID == 0 || campaign.Budget < 0 {
+		http.Error(w, "A campaign needs an advertiser_id and a non-negative budget.", 400)
+		return
+	}
+	if !validFrequencyCap(campaign.FrequencyCap) {
+		http.Error(w, "Frequency cap needs positive impressions and a window of at least 1s.", 400)
+		return
+	}
+	if err := campaign.Targeting.normalize(); err != nil {
+		http.Error(w, err.Error()+".", 400)
+		return
+	}
+	if err := checkDailyBudget(campaign.DailyBudget, &campaign.Pacing); err != nil {
+		http.Error(w, err.Error()+".", 400)
+		return
+	}
+
+	id, err := s.campaigns.InsertCampaign(campaign)
+	if err != nil {
+		writeCampaignError(w, err)
+		return
+	}
+	campaign.CampaignID = id
+	writeJSON(w, campaign)
+}
+
+/*
+apply the fields present in an update request onto the stored campaign
+a field left out keeps its stored value, null clears start_time, end_time, frequency_cap and targeting
+the owner and the budget are not changed here
+*/
+func mergeCampaign(stored Campaign, body []byte) (Campaign, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return stored, err
+	}
+	var patch Campaign
+	if err := json.Unmarshal(body, &patch); err != nil {
+		return stored, err
+	}
+
+	merged := stored
+	for field := range fields {
+		switch field {
+		case "name":
+			merged.Name = patch.Name
+		case "start_time":
+			merged.StartTime = patch.StartTime
+		case "end_time":
+			merged.EndTime = patch.EndTime
+		case "placements":
+			merged.Placements = patch.Placements
+		case "paused":
+			merged.Paused = patch.Paused
+		case "frequency_cap":
+			merged.FrequencyCap = patch.FrequencyCap
+		case "targeting":
+			merged.Targeting = patch.Targeting
+		case "daily_budget":
+			merged.DailyBudget = patch.DailyBudget
+		case "pacing":
+			merged.Pacing = patch.Pacing
+		}
+	}
+	return merged, nil
+}
+
+/*
+apply the fields present in an update request onto the stored ad group
+a field left out keeps its stored value, the campaign of the group is not changed here
+*/
+func mergeAdGroup(stored AdGroup, body []byte) (AdGroup, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return stored, err
+	}
+	var patch AdGroup
+	if err := json.Unmarshal(body, &patch); err != nil {
+		return stored, err
+	}
+
+	merged := stored
+	for field := range fields {
+		switch field {
+		case "name":
+			merged.Name = patch.Name
+		case "default_bid":
+			merged.DefaultBid = patch.DefaultBid
+		case "paused":
+			merged.Paused = patch.Paused
+		}
+	}
+	return merged, nil
+}
+
+/*
+HanldeFunction
+POST {"campaign_id": 1, ...}: change the fields present in the request, the others keep their values
+name, daily budget, pacing, schedule, placements, paused, frequency cap and targeting are replaced,
+a new "budget" is applied as the difference to the stored budget through ChangeBudget (ledger type campaign_budget)
+*/
+func (s *server) handleFuncUpdateCampaign(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received one campaign update request")
+	w.Header().Set("Content-Type", "text/plain")
+
+	if req.Method != "POST" {
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, "Cannot read campaign's data from client", 400)
+		return
+	}
+	var request struct {
+		CampaignID int    `json:"campaign_id"`
+		Budget     *Money `json:"budget"`
+	}
+	if err = json.Unmarshal(body, &request); err != nil {
+		http.Error(w, "Cannot decode campaign's data from client", 400)
+		log.Println("Cannot decode campaign's data from client.", err)
+		return
+	}
+	if request.Budget != nil && *request.Budget < 0 {
+		http.Error(w, "Campaign budget must not be negative.", 400)
+		return
+	}
+
+	stored, err := s.campaigns.SelectCampaign(request.CampaignID)
+	if err != nil {
+		writeCampaignError(w, err)
+		return
+	}
+	campaign, err := mergeCampaign(stored, body)
+	if err != nil {
+		http.Error(w, "Cannot decode campaign's data from client", 400)
+		log.Println("Cannot decode campaign's data from client.", err)
+		return
+	}
+	if !validFrequencyCap(campaign.FrequencyCap) {
+		http.Error(w, "Frequency cap needs positive impressions and a window of at least 1s.", 400)
+		return
+	}
+	if err := campaign.Targeting.normalize(); err != nil {
+		http.Error(w, err.Error()+".", 400)
+		return
+	}
+	if err := checkDailyBudget(campaign.DailyBudget, &campaign.Pacing); err != nil {
+		http.Error(w, err.Error()+".", 400)
+		return
+	}
+
+	// the budget first: when it cannot change, nothing does
+	if request.Budget != nil && *request.Budget != stored.Budget {
+		changed, err := s.advertisers.ChangeBudget(stored.AdvertiserID, stored.CampaignID, *request.Budget-stored.Budget, transactionCampaignBudget, 0)
+		if err != nil {
+			writeBudgetError(w, err)
+			return
+		}
+		if !changed {
+			http.Error(w, "Insufficient budget.", 400)
+			return
+		}
+	}
+
+	if err := s.campaigns.UpdateCampaign(campaign); err != nil {
+		writeCampaignError(w, err)
+		return
+	}
+	w.Write([]byte("Campaign updated successfully"))
+}
+
+func (s *server) handleFuncDeleteCampaign(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received one campaign deletion request")
+	w.Header().Set("Content-Type", "text/plain")
+
+	if req.Method != "POST" {
+		return
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	var campaign Campaign
+	if err := decoder.Decode(&campaign); err != nil {
+		http.Error(w, "Cannot decode campaign's data from client", 400)
+		log.Println("Cannot decode campaign's data from client.", err)
+		return
+	}
+
+	if err := s.campaigns.DeleteCampaign(campaign.CampaignID); err != nil {
+		writeCampaignError(w, err)
+		return
+	}
+	w.Write([]byte("Successfully deleted a campaign."))
+}
+
+/*
+HanldeFunction
+response the client with all campaigns of an advertiser_id
+*/
+func (s *server) handleFuncSearchCampaigns(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received one search campaigns request")
+	w.Header().Set("Content-Type", "text/plain")
+
+	if req.Method != "POST" {
+		return
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	var campaign Campaign
+	if err := decoder.Decode(&campaign); err != nil || campaign.AdvertiserID == 0 {
+		http.Error(w, "Cannot decode advertiser_id from client", 400)
+		log.Println("Cannot decode advertiser_id from client.", err)
+		return
+	}
+
+	campaigns, err := s.campaigns.SelectCampaigns(campaign.AdvertiserID)
+	if err != nil {
+		writeCampaignError(w, err)
+		return
+	}
+	writeJSON(w, campaigns)
+}
+
+/*
+HanldeFunction
+add an ad group to an existing campaign, response the client with the stored ad group
+*/
+func (s *server) handleFuncAddAdGroup(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received one ad group insertion request")
+	w.Header().Set("Content-Type", "text/plain")
+
+	if req.Method != "POST" {
+		return
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	var group AdGroup
+	if err := decoder.Decode(&group); err != nil {
+		http.Error(w, "Cannot decode ad group's data from client", 400)
+		log.Println("Cannot decode ad group's data from client.", err)
+		return
+	}
+	if group.DefaultBid < 0 {
+		http.Error(w, "Default bid must not be negative.", 400)
+		return
+	}
+	if _, err := s.campaigns.SelectCampaign(group.CampaignID); err != nil {
+		writeCampaignError(w, err)
+		return
+	}
+
+	id, err := s.campaigns.InsertAdGroup(group)
+	if err != nil {
+		writeCampaignError(w, err)
+		return
+	}
+	group.AdGroupID = id
+	writeJSON(w, group)
+}
+
+/*
+HanldeFunction
+POST {"ad_group_id": 1, ...}: change the fields present in the request, the others keep their values
+name, default bid and paused can be changed
+*/
+func (s *server) handleFuncUpdateAdGroup(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received one ad group update request")
+	w.Header().Set("Content-Type", "text/plain")
+
+	if req.Method != "POST" {
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, "Cannot read ad group's data from client", 400)
+		return
+	}
+	var request AdGroup
+	if err = json.Unmarshal(body, &request); err != nil {
+		http.Error(w, "Cannot decode ad group's data from client", 400)
+		log.Println("Cannot decode ad group's data from client.", err)
+		return
+	}
+
+	stored, err := s.campaigns.SelectAdGroup(request.AdGroupID)
+	if err != nil {
+		writeCampaignError(w, err)
+		return
+	}
+	group, err := mergeAdGroup(stored, body)
+	if err != nil {
+		http.Error(w, "Cannot decode ad group's data from client", 400)
+		log.Println("Cannot decode ad group's data from client.", err)
+		return
+	}
+	if group.DefaultBid < 0 {
+		http.Error(w, "Default bid must not be negative.", 400)
+		return
+	}
+
+	if err := s.campaigns.UpdateAdGroup(group); err != nil {
+		writeCampaignError(w, err)
+		return
+	}
+	w.Write([]byte("Ad group updated successfully"))
+}
+
+func (s *server) handleFuncDeleteAdGroup(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received one ad group deletion request")
+	w.Header().Set("Content-Type", "text/plain")
+
+	if req.Method != "POST" {
+		return
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	var group AdGroup
+	if err := decoder.Decode(&group); err != nil {
+		http.Error(w, "Cannot decode ad group's data from client", 400)
+		log.Println("Cannot decode ad group's data from client.", err)
+		return
+	}
+
+	if err := s.campaigns.DeleteAdGroup(group.AdGroupID); err != nil {
+		writeCampaignError(w, err)
+		return
+	}
+	w.Write([]byte("Successfully deleted an ad group."))
+}
+
+/*
+HanldeFunction
+response the client with all ad groups of a campaign_id
+*/
+func (s *server) handleFuncSearchAdGroups(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received one search ad groups request")
+	w.Header().Set("Content-Type", "text/plain")
+
+	if req.Method != "POST" {
+		return
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	var group AdGroup
+	if err := decoder.Decode(&group); err != nil || group.CampaignID == 0 {
+		http.Error(w, "Cannot decode campaign_id from client", 400)
+		log.Println("Cannot decode campaign_id from client.", err)
+		return
+	}
+
+	groups, err := s.campaigns.SelectAdGroups(group.CampaignID)
+	if err != nil {
+		writeCampaignError(w, err)
+		return
+	}
+	writeJSON(w, groups)
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+in-memory copy of what every auction reads besides the ads:
+the ad groups, the campaigns and the advertiser budgets
+kept current by the stores wrapping the campaign and advertiser stores (changes made by this server)
+and reloaded every refresh interval (changes made by other servers / by hand in MySQL)
+everything is keyed by id and built once per reload: an auction only looks up the ids of its candidate ads
+*/
+type catalog struct {
+	campaignStore   CampaignStore
+	advertiserStore AdvertiserStore
+	// charges not written to the store yet, taken off the budgets read from it; nil: none
+	spend *spendWriter
+	// held with the spend writer by holdSpendWriter, so reloads and budget changes exclude each other without one
+	reloadMu sync.Mutex
+
+	mu sync.RWMutex
+	// ad_group_id / campaign_id ==> group / campaign; replaced by a reload, never changed in place
+	groups    map[int]AdGroup
+	campaigns map[int]Campaign
+	// advertiser_id / campaign_id ==> budget left; the Budget of the campaigns above is not kept current
+	budgets         map[int]Money
+	campaignBudgets map[int]Money
+	// advertiser_id ==> daily budget, only the advertisers with one
+	dailyBudgets map[int]dailyBudget
+	// spend of the day starting at "day": advertiser_id / campaign_id ==> amount
+	day                time.Time
+	spentToday         map[int]Money
+	campaignSpentToday map[int]Money
+}
+
+/*
+load the catalog from the underlying stores, less the spend not flushed to them yet
+*/
+func newCatalog(campaigns CampaignStore, advertisers AdvertiserStore, spend *spendWriter) (*catalog, error) {
+	c := &catalog{campaignStore: campaigns, advertiserStore: advertisers, spend: spend}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+/*
+replace the whole catalog
+*/
+func (c *catalog) reload() error {
+	c.holdSpendWriter()
+	defer c.releaseSpendWriter()
+	now := time.Now()
+	advertiserSpend, campaignSpend := c.pendingSpend()
+	advertiserToday, campaignToday := c.pendingSpendSince(startOfDay(now))
+
+	groups, err := c.campaignStore.SelectAdGroups(0)
+	if err != nil {
+		return err
+	}
+	campaigns, err := c.campaignStore.SelectCampaigns(0)
+	if err != nil {
+		return err
+	}
+	budgets, err := c.advertiserStore.SelectAdvertiserBudgets()
+	if err != nil {
+		return err
+	}
+	groupByID, campaignByID, campaignBudgets := indexHierarchy(groups, campaigns)
+	subtractPending(budgets, advertiserSpend)
+	subtractPending(campaignBudgets, campaignSpend)
+	dailyBudgets, spent, campaignSpent, err := c.loadDailySpend(now, advertiserToday, campaignToday)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.groups, c.campaigns, c.budgets, c.campaignBudgets = groupByID, campaignByID, budgets, campaignBudgets
+	c.dailyBudgets, c.day, c.spentToday, c.campaignSpentToday = dailyBudgets, startOfDay(now), spent, campaignSpent
+	return nil
+}
+
+/*
+stop the spend writer from journaling charges, and the other reloads and budget changes, until releaseSpendWriter:
+from the pending spend read at the start of a reload until the reloaded copy replaces the old one,
+no charge can be taken from the old copy only
+*/
+func (c *catalog) holdSpendWriter() {
+	c.reloadMu.Lock()
+	if c.spend != nil {
+		c.spend.mu.Lock()
+	}
+}
+
+func (c *catalog) releaseSpendWriter() {
+	if c.spend != nil {
+		c.spend.mu.Unlock()
+	}
+	c.reloadMu.Unlock()
+}
+
+// the charges not flushed yet; called between holdSpendWriter and releaseSpendWriter
+func (c *catalog) pendingSpend() (map[int]Money, map[int]Money) {
+	if c.spend == nil {
+		return map[int]Money{}, map[int]Money{}
+	}
+	return c.spend.pending()
+}
+
+// the charges made since "day" not flushed yet; called between holdSpendWriter and releaseSpendWriter
+func (c *catalog) pendingSpendSince(day time.Time) (map[int]Money, map[int]Money) {
+	if c.spend == nil {
+		return map[int]Money{}, map[int]Money{}
+	}
+	return c.spend.pendingSince(day)
+}
+
+/*
+key the ad groups and campaigns by id, and take out the campaign budgets
+*/
+func indexHierarchy(groups []AdGroup, campaigns []Campaign) (map[int]AdGroup, map[int]Campaign, map[int]Money) {
+	groupByID := make(map[int]AdGroup, len(groups))
+	for _, g := range groups {
+		groupByID[g.AdGroupID] = g
+	}
+	campaignByID := make(map[int]Campaign, len(campaigns))
+	campaignBudgets := make(map[int]Money, len(campaigns))
+	for _, c := range campaigns {
+		campaignByID[c.CampaignID] = c
+		campaignBudgets[c.CampaignID] = c.Budget
+	}
+	return groupByID, campaignByID, campaignBudgets
+}
+
+/*
+take the charges the spend writer has not flushed yet off budgets freshly read from the store
+the pending charges are read before the store: a batch flushed in between is in both and
+is taken off twice until the next reload, auctions err on the safe side
+*/
+func subtractPending(budgets map[int]Money, pending map[int]Money) {
+	for id, amount := range pending {
+		if _, ok := budgets[id]; ok {
+			budgets[id] -= amount
+		}
+	}
+}
+
+/*
+reload the campaigns and ad groups after one of them changed
+*/
+func (c *catalog) reloadHierarchy() error {
+	c.holdSpendWriter()
+	defer c.releaseSpendWriter()
+	_, campaignSpend := c.pendingSpend()
+
+	groups, err := c.campaignStore.SelectAdGroups(0)
+	if err != nil {
+		return err
+	}
+	campaigns, err := c.campaignStore.SelectCampaigns(0)
+	if err != nil {
+		return err
+	}
+	groupByID, campaignByID, campaignBudgets := indexHierarchy(groups, campaigns)
+	subtractPending(campaignBudgets, campaignSpend)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.groups, c.campaigns, c.campaignBudgets = groupByID, campaignByID, campaignBudgets
+	return nil
+}
+
+/*
+reload the advertiser budgets after an advertiser was added
+*/
+func (c *catalog) reloadBudgets() error {
+	c.holdSpendWriter()
+	defer c.releaseSpendWriter()
+	advertiserSpend, _ := c.pendingSpend()
+
+	budgets, err := c.advertiserStore.SelectAdvertiserBudgets()
+	if err != nil {
+		return err
+	}
+	subtractPending(budgets, advertiserSpend)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.budgets = budgets
+	return nil
+}
+
+/*
+apply a budget change that was committed to the store
+*/
+func (c *catalog) applyBudgetChange(advertiserID, campaignID int, amount Money) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.changeBudget(advertiserID, campaignID, amount)
+}
+
+/*
+apply a campaign budget change committed to the store, the advertiser budget stays as it is
+*/
+func (c *catalog) applyCampaignBudgetChange(campaignID int, amount Money) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.changeCampaignBudget(campaignID, amount)
+}
+
+// applyBudgetChange with mu held
+func (c *catalog) changeBudget(advertiserID, campaignID int, amount Money) {
+	c.budgets[advertiserID] += amount
+	if campaignID != 0 {
+		c.changeCampaignBudget(campaignID, amount)
+	}
+}
+
+// applyCampaignBudgetChange with mu held
+func (c *catalog) changeCampaignBudget(campaignID int, amount Money) {
+	if _, ok := c.campaignBudgets[campaignID]; ok {
+		c.campaignBudgets[campaignID] += amount
+	}
+}
+
+/*
+take "cost" from the advertiser budget and the campaign budget (campaignID not 0) if both can pay it,
+count it in today's spend
+the daily budgets only keep advertisers and campaigns out of auctions (pacingState):
+an ad already served is billed even when its charge goes past the daily budget
+return:
+	taken: true
+	a budget is too small: false
+*/
+func (c *catalog) reserveSpend(advertiserID, campaignID int, cost Money, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rollDay(now)
+
+	if c.budgets[advertiserID] < cost {
+		return false
+	}
+	if budget, ok := c.campaignBudgets[campaignID]; ok && budget < cost {
+		return false
+	}
+	c.changeBudget(advertiserID, campaignID, -cost)
+	c.spentToday[advertiserID] += cost
+	if campaignID != 0 {
+		c.campaignSpentToday[campaignID] += cost
+	}
+	return true
+}
+
+/*
+give back a spend taken by reserveSpend
+*/
+func (c *catalog) releaseSpend(advertiserID, campaignID int, cost Money) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.changeBudget(advertiserID, campaignID, cost)
+	c.spentToday[advertiserID] -= cost
+	if campaignID != 0 {
+		c.campaignSpentToday[campaignID] -= cost
+	}
+}
+
+/*
+the ad groups and campaigns by id, for one auction; read only
+*/
+func (c *catalog) hierarchy() (map[int]AdGroup, map[int]Campaign) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.groups, c.campaigns
+}
+
+/*
+the budgets left of the advertisers and campaigns of "ads", for one auction
+return:
+	advertiser_id ==> budget, campaign_id ==> budget
+*/
+func (c *catalog) budgetsOf(ads []Ad) (map[int]Money, map[int]Money) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	budgets := map[int]Money{}
+	campaignBudgets := map[int]Money{}
+	for _, ad := range ads {
+		budgets[ad.AdvertiserID] = c.budgets[ad.AdvertiserID]
+		if ad.CampaignID != 0 {
+			campaignBudgets[ad.CampaignID] = c.campaignBudgets[ad.CampaignID]
+		}
+	}
+	return budgets, campaignBudgets
+}
+
+/*
+reload the catalog and the ad index every "interval": nothing an auction reads is older than that
+a failed reload keeps the previous copy and is retried at the next interval
+*/
+func (s *server) runCatalogRefresher(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := s.catalog.reload(); err != nil {
+			log.Println("Failed to reload the catalog:", err)
+			continue
+		}
+		ads, err := s.ads.SelectActiveAds()
+		if err != nil {
+			log.Println("Failed to reload the ad index:", err)
+			continue
+		}
+		s.index.load(ads)
+	}
+}
+
+/*
+CampaignStore that reloads the catalog's campaigns and ad groups after every change made through it
+*/
+type cachedCampaignStore struct {
+	CampaignStore
+	catalog *catalog
+}
+
+// after a successful change, refresh the catalog; a failed refresh waits for the refresher
+func (store *cachedCampaignStore) changed(err error) error {
+	if err == nil {
+		if reloadErr := store.catalog.reloadHierarchy(); reloadErr != nil {
+			log.Println("Failed to reload campaigns into the catalog:", reloadErr)
+		}
+	}
+	return err
+}
+
+func (store *cachedCampaignStore) InsertCampaign(campaign Campaign) (int, error) {
+	id, err := store.CampaignStore.InsertCampaign(campaign)
+	return id, store.changed(err)
+}
+
+func (store *cachedCampaignStore) UpdateCampaign(campaign Campaign) error {
+	return store.changed(store.CampaignStore.UpdateCampaign(campaign))
+}
+
+func (store *cachedCampaignStore) DeleteCampaign(campaignID int) error {
+	return store.changed(store.CampaignStore.DeleteCampaign(campaignID))
+}
+
+func (store *cachedCampaignStore) InsertAdGroup(group AdGroup) (int, error) {
+	id, err := store.CampaignStore.InsertAdGroup(group)
+	return id, store.changed(err)
+}
+
+func (store *cachedCampaignStore) UpdateAdGroup(group AdGroup) error {
+	return store.changed(store.CampaignStore.UpdateAdGroup(group))
+}
+
+func (store *cachedCampaignStore) DeleteAdGroup(adGroupID int) error {
+	return store.changed(store.CampaignStore.DeleteAdGroup(adGroupID))
+}
+
+/*
+AdvertiserStore that keeps the catalog's budgets in step with every change made through it
+*/
+type cachedAdvertiserStore struct {
+	AdvertiserStore
+	catalog *catalog
+}
+
+func (store *cachedAdvertiserStore) InsertAdvertiser(advertiser Advertiser) error {
+	if err := store.AdvertiserStore.InsertAdvertiser(advertiser); err != nil {
+		return err
+	}
+	if err := store.catalog.reloadBudgets(); err != nil {
+		log.Println("Failed to reload budgets into the catalog:", err)
+	}
+	if err := store.catalog.reloadDailyBudgets(); err != nil {
+		log.Println("Failed to reload daily budgets into the catalog:", err)
+	}
+	return nil
+}
+
+func (store *cachedAdvertiserStore) SetDailyBudget(advertiserID int, amount Money, pacing string) error {
+	if err := store.AdvertiserStore.SetDailyBudget(advertiserID, amount, pacing); err != nil {
+		return err
+	}
+	if err := store.catalog.reloadDailyBudgets(); err != nil {
+		log.Println("Failed to reload daily budgets into the catalog:", err)
+	}
+	return nil
+}
+
+/*
+change the budget in the store, then in the catalog
+no reload runs in between (they hold the spend writer too): a reload reading the committed change
+and the catalog applying it on top would count it twice
+*/
+func (store *cachedAdvertiserStore) ChangeBudget(advertiserID int, campaignID int, amount Money, txType string, adID int) (bool, error) {
+	store.catalog.holdSpendWriter()
+	defer store.catalog.releaseSpendWriter()
+	changed, err := store.AdvertiserStore.ChangeBudget(advertiserID, campaignID, amount, txType, adID)
+	if changed && err == nil {
+		if txType == transactionCampaignBudget {
+			store.catalog.applyCampaignBudgetChange(campaignID, amount)
+		} else {
+			store.catalog.applyBudgetChange(advertiserID, campaignID, amount)
+		}
+	}
+	return changed, err
+}
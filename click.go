@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// key signing the click tokens, set with -click-secret
+// empty at startup: a random key, and tokens do not survive a restart
+var clickSecret []byte
+
+// how long a click url stays valid, set with -click-ttl
+var clickTTL = 24 * time.Hour
+
+// prefix of the click urls, e.g. https://ads.example.com, set with -click-base-url
+// empty: the urls are relative ("/click?token=...")
+var clickBaseURL = ""
+
+/*
+a random signing key for a server started without -click-secret
+*/
+func randomClickSecret() ([]byte, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, errors.New("Failed to generate click secret")
+	}
+	return secret, nil
+}
+
+/*
+the landing url of an ad must be an absolute http(s) url:
+anything else would turn /click into an open redirect to javascript: or data: urls
+*/
+func validLandingURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func signClickPayload(payload string) string {
+	mac := hmac.New(sha256.New, clickSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+/*
+token of a click on "adID" served by "auctionID", valid until "expires":
+	base64url("auctionID:adID:expires unix") "." base64url(hmac-sha256 of the payload)
+*/
+func clickToken(auctionID string, adID int, expires time.Time) string {
+	payload := auctionID + ":" + strconv.Itoa(adID) + ":" + strconv.FormatInt(expires.Unix(), 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + signClickPayload(payload)
+}
+
+/*
+the tracking url answered with a served ad that has a landing url
+*/
+func clickURL(token string) string {
+	return clickBaseURL + "/click?token=" + url.QueryEscape(token)
+}
+
+/*
+check the signature and the expiry of a click token
+return:
+	auction id, ad id, nil
+	forged or damaged token: "Invalid click token"
+	expired token: "Click token expired"
+*/
+func parseClickToken(token string, now time.Time) (string, int, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return "", 0, errors.New("Invalid click token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", 0, errors.New("Invalid click token")
+	}
+	if !hmac.Equal([]byte(parts[1]), []byte(signClickPayload(string(payload)))) {
+		return "", 0, errors.New("Invalid click token")
+	}
+
+	fields := strings.Split(string(payload), ":")
+	if len(fields) != 3 {
+		return "", 0, errors.New("Invalid click token")
+	}
+	adID, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return "", 0, errors.New("Invalid click token")
+	}
+	expires, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return "", 0, errors.New("Invalid click token")
+	}
+	if now.Unix() > expires {
+		return "", 0, errors.New("Click token expired")
+	}
+	return fields[0], adID, nil
+}
+
+/*
+check that the token of a click event was issued for its auction and ad
+return:
+	nil
+	no, forged or another ad's token: "Invalid click token"
+	expired token: "Click token expired"
+*/
+func checkClickToken(event AdEvent, now time.Time) error {
+	auctionID, adID, err := parseClickToken(event.Token, now)
+	if err != nil {
+		return err
+	}
+	if auctionID != event.AuctionID || adID != event.AdID {
+		return errors.New("Invalid click token")
+	}
+	return nil
+}
+
+/*
+HanldeFunction
+GET /click?token=...
+validate the signed token, record the click (charging a cpc ad once) and redirect to the landing page
+only a forged, damaged or expired token stops the redirect, a click that fails to be recorded is logged
+*/
+func (s *server) handleFuncClickRedirect(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received one click redirect")
+	w.Header().Set("Content-Type", "text/plain")
+
+	if req.Method != "GET" {
+		return
+	}
+
+	token := req.URL.Query().Get("token")
+	auctionID, adID, err := parseClickToken(token, time.Now())
+	if err != nil {
+		if err.Error() == "Click token expired" {
+			http.Error(w, "Click token expired.", 410)
+		} else {
+			http.Error(w, "Invalid click token.", 403)
+		}
+		return
+	}
+
+	ad, err := s.ads.SelectAd(adID)
+	if err != nil {
+		if err.Error() == "Ad not found" {
+			http.Error(w, "Ad not found.", 404)
+		} else {
+			http.Error(w, err.Error()+".", 500)
+		}
+		return
+	}
+	if ad.LandingURL == "" {
+		http.Error(w, "Ad has no landing url.", 404)
+		return
+	}
+
+	// a duplicate click is ignored but still lands on the page,
+	// so does a click that could not be recorded: the token was good, the user is not at fault
+	message, err := s.trackEvent(AdEvent{AuctionID: auctionID, AdID: adID, Token: token}, eventClick)
+	if err != nil {
+		log.Printf("Auction %s ad %d: failed to record the click: %v\n", auctionID, adID, err)
+	} else {
+		log.Printf("Auction %s ad %d: %s\n", auctionID, adID, message)
+	}
+	http.Redirect(w, req, ad.LandingURL, http.StatusFound)
+}
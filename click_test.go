@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseClickToken(t *testing.T) {
+	clickSecret = []byte("test secret")
+	now := time.Unix(1700000000, 0)
+	valid := clickToken("auction1", 7, now.Add(time.Hour))
+	signed := func(payload string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + signClickPayload(payload)
+	}
+
+	tests := []struct {
+		name          string
+		token         string
+		wantAuctionID string
+		wantAdID      int
+		wantErr       string
+	}{
+		{"valid", valid, "auction1", 7, ""},
+		{"expires this second", clickToken("auction1", 7, now), "auction1", 7, ""},
+		{"expired", clickToken("auction1", 7, now.Add(-time.Second)), "", 0, "Click token expired"},
+		{"empty", "", "", 0, "Invalid click token"},
+		{"no signature", base64.RawURLEncoding.EncodeToString([]byte("auction1:7:1700003600")), "", 0, "Invalid click token"},
+		{"bad base64", "!!!." + signClickPayload("x"), "", 0, "Invalid click token"},
+		{"payload of another ad", strings.Split(clickToken("auction1", 8, now.Add(time.Hour)), ".")[0] + "." + strings.Split(valid, ".")[1], "", 0, "Invalid click token"},
+		{"damaged signature", valid + "x", "", 0, "Invalid click token"},
+		{"missing field", signed("auction1:7"), "", 0, "Invalid click token"},
+		{"ad id not a number", signed("auction1:x:1700003600"), "", 0, "Invalid click token"},
+		{"expiry not a number", signed("auction1:7:soon"), "", 0, "Invalid click token"},
+	}
+	for _, tt := range tests {
+		auctionID, adID, err := parseClickToken(tt.token, now)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || auctionID != tt.wantAuctionID || adID != tt.wantAdID {
+			t.Errorf("%s: parseClickToken = %q, %d, %v, want %q, %d", tt.name, auctionID, adID, err, tt.wantAuctionID, tt.wantAdID)
+		}
+	}
+}
+
+func TestCheckClickToken(t *testing.T) {
+	clickSecret = []byte("test secret")
+	now := time.Unix(1700000000, 0)
+	token := clickToken("auction1", 7, now.Add(time.Hour))
+
+	tests := []struct {
+		name    string
+		event   AdEvent
+		wantErr bool
+	}{
+		{"token of the ad", AdEvent{AuctionID: "auction1", AdID: 7, Token: token}, false},
+		{"no token", AdEvent{AuctionID: "auction1", AdID: 7}, true},
+		{"token of another auction", AdEvent{AuctionID: "auction2", AdID: 7, Token: token}, true},
+		{"token of another ad", AdEvent{AuctionID: "auction1", AdID: 8, Token: token}, true},
+	}
+	for _, tt := range tests {
+		if err := checkClickToken(tt.event, now); (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkClickToken = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Config type: everything the server reads once at startup
+// values come from, lowest priority first:
+//
+//	defaultConfig
+//	the JSON file named by -config (or ADSYS_CONFIG)
+//	ADSYS_* environment variables
+//	command line flags
+type Config struct {
+	Store         string        `json:"store"`
+	DSN           string        `json:"dsn"`
+	ListenAddress string        `json:"listen_address"`
+	ReadTimeout   Duration      `json:"read_timeout"`
+	WriteTimeout  Duration      `json:"write_timeout"`
+	DBPool        DBPoolJSON    `json:"db_pool"`
+	Auction       AuctionConfig `json:"auction"`
+	Click         ClickConfig   `json:"click"`
+	AdScore       AdScoreConfig `json:"ad_score"`
+	Catalog       CatalogConfig `json:"catalog"`
+	Spend         SpendConfig   `json:"spend"`
+	Log           LogConfig     `json:"log"`
+}
+
+// DBPoolJSON type: DBPoolConfig as written in the config file
+type DBPoolJSON struct {
+	MaxOpenConns    int      `json:"max_open_conns"`
+	MaxIdleConns    int      `json:"max_idle_conns"`
+	ConnMaxLifetime Duration `json:"conn_max_lifetime"`
+}
+
+// AuctionConfig type
+type AuctionConfig struct {
+	Mechanism        string           `json:"mechanism"`
+	ReservePrice     Money            `json:"reserve_price"`
+	PlacementFloors  map[string]Money `json:"placement_floors"`
+	VCGPositionDecay float64          `json:"vcg_position_decay"`
+	// expected conversions per click of cpa ads, used to rank them
+	CPAConversionRate float64 `json:"cpa_conversion_rate"`
+}
+
+// ClickConfig type: signed click tracking urls
+type ClickConfig struct {
+	// HMAC key of the click tokens; empty: a random key per process
+	Secret string `json:"secret"`
+	// how long a click url stays valid
+	TTL Duration `json:"ttl"`
+	// prefix of the click urls, e.g. https://ads.example.com; empty: relative urls
+	BaseURL string `json:"base_url"`
+}
+
+// AdScoreConfig type: the adscore learned from click-through rates
+type AdScoreConfig struct {
+	// ctr a new ad starts at
+	PriorCTR float64 `json:"prior_ctr"`
+	// number of impressions the prior is worth
+	PriorWeight float64 `json:"prior_weight"`
+	// how often the background job recomputes the adscores
+	RefreshInterval Duration `json:"refresh_interval"`
+}
+
+// CatalogConfig type: the in-memory copy of the ads, campaigns and budgets the auctions read
+type CatalogConfig struct {
+	// the copy is reloaded from the store at least this often, catching changes made by other servers
+	MaxStaleness Duration `json:"max_staleness"`
+}
+
+// SpendConfig type: the write-behind of the auction charges
+type SpendConfig struct {
+	// local file the charges are appended to until they are flushed
+	JournalFile string `json:"journal_file"`
+	// how often the journaled charges are written to the budgets in the store
+	FlushInterval Duration `json:"flush_interval"`
+}
+
+// LogConfig type
+type LogConfig struct {
+	// empty: standard error
+	File string `json:"file"`
+	// add microseconds to the log timestamps
+	Microseconds bool `json:"microseconds"`
+}
+
+// Duration is a time.Duration written as "1.5s", "300ms" in JSON
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON reads a duration string such as "5s"
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New("Duration must be a string such as \"5s\"")
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+// MarshalJSON writes the duration as a string such as "5s"
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func defaultConfig() Config {
+	return Config{
+		Store:         "mysql",
+		DSN:           mysqlDataSourceName,
+		ListenAddress: "localhost:8080",
+		ReadTimeout:   Duration{10 * time.Second},
+		WriteTimeout:  Duration{10 * time.Second},
+		DBPool: DBPoolJSON{
+			MaxOpenConns:    20,
+			MaxIdleConns:    10,
+			ConnMaxLifetime: Duration{5 * time.Minute},
+		},
+		Auction: AuctionConfig{
+			Mechanism:         "gsp",
+			ReservePrice:      minBidIncrement,
+			PlacementFloors:   map[string]Money{},
+			VCGPositionDecay:  0.7,
+			CPAConversionRate: 0.05,
+		},
+		Click: ClickConfig{
+			TTL: Duration{24 * time.Hour},
+		},
+		AdScore: AdScoreConfig{
+			PriorCTR:        0.02,
+			PriorWeight:     100,
+			RefreshInterval: Duration{10 * time.Minute},
+		},
+		Catalog: CatalogConfig{
+			MaxStaleness: Duration{30 * time.Second},
+		},
+		Spend: SpendConfig{
+			JournalFile:   "spend.journal",
+			FlushInterval: Duration{5 * time.Second},
+		},
+	}
+}
+
+// a setting that can be overridden by an environment variable and a flag
+type configSetting struct {
+	flag  string
+	env   string
+	usage string
+	set   func(cfg *Config, value string) error
+}
+
+var configSettings = []configSetting{
+	{"store", "ADSYS_STORE", "where ads and advertisers are kept: mysql or memory (local development)",
+		func(cfg *Config, v string) error { cfg.Store = v; return nil }},
+	{"dsn", "ADSYS_DSN", "MySQL data source name",
+		func(cfg *Config, v string) error { cfg.DSN = v; return nil }},
+	{"listen", "ADSYS_LISTEN_ADDRESS", "address the HTTP server listens on",
+		func(cfg *Config, v string) error { cfg.ListenAddress = v; return nil }},
+	{"read-timeout", "ADSYS_READ_TIMEOUT", "longest time to read a request",
+		func(cfg *Config, v string) error { return setDuration(&cfg.ReadTimeout, v) }},
+	{"write-timeout", "ADSYS_WRITE_TIMEOUT", "longest time to write a response",
+		func(cfg *Config, v string) error { return setDuration(&cfg.WriteTimeout, v) }},
+	{"db-max-open", "ADSYS_DB_MAX_OPEN", "most open MySQL connections (0: no limit)",
+		func(cfg *Config, v string) error { return setInt(&cfg.DBPool.MaxOpenConns, v) }},
+	{"db-max-idle", "ADSYS_DB_MAX_IDLE", "most idle MySQL connections kept in the pool",
+		func(cfg *Config, v string) error { return setInt(&cfg.DBPool.MaxIdleConns, v) }},
+	{"db-conn-lifetime", "ADSYS_DB_CONN_LIFETIME", "longest time a MySQL connection is reused (0: forever)",
+		func(cfg *Config, v string) error { return setDuration(&cfg.DBPool.ConnMaxLifetime, v) }},
+	{"auction", "ADSYS_AUCTION", "default auction mechanism: gsp, first_price or vcg",
+		func(cfg *Config, v string) error { cfg.Auction.Mechanism = v; return nil }},
+	{"reserve", "ADSYS_RESERVE_PRICE", "reserve price: the lowest cpc any winner pays",
+		func(cfg *Config, v string) error { return cfg.Auction.ReservePrice.Set(v) }},
+	{"floors", "ADSYS_PLACEMENT_FLOORS", "per-placement floors on bid * adscore, e.g. header=2.5,sidebar=1",
+		func(cfg *Config, v string) (err error) { cfg.Auction.PlacementFloors, err = parseFloors(v); return err }},
+	{"vcg-position-decay", "ADSYS_VCG_POSITION_DECAY", "vcg: ctr of position k+1 relative to position k",
+		func(cfg *Config, v string) error { return setFloat(&cfg.Auction.VCGPositionDecay, v) }},
+	{"cpa-conversion-rate", "ADSYS_CPA_CONVERSION_RATE", "expected conversions per click of cpa ads, used to rank them",
+		func(cfg *Config, v string) error { return setFloat(&cfg.Auction.CPAConversionRate, v) }},
+	{"click-secret", "ADSYS_CLICK_SECRET", "HMAC key signing the click urls (default: random per process)",
+		func(cfg *Config, v string) error { cfg.Click.Secret = v; return nil }},
+	{"click-ttl", "ADSYS_CLICK_TTL", "how long a click url stays valid",
+		func(cfg *Config, v string) error { return setDuration(&cfg.Click.TTL, v) }},
+	{"click-base-url", "ADSYS_CLICK_BASE_URL", "prefix of the click urls, e.g. https://ads.example.com",
+		func(cfg *Config, v string) error { cfg.Click.BaseURL = v; return nil }},
+	{"score-prior-ctr", "ADSYS_SCORE_PRIOR_CTR", "adscore (ctr) of an ad without history",
+		func(cfg *Config, v string) error { return setFloat(&cfg.AdScore.PriorCTR, v) }},
+	{"score-prior-weight", "ADSYS_SCORE_PRIOR_WEIGHT", "number of impressions the prior adscore is worth",
+		func(cfg *Config, v string) error { return setFloat(&cfg.AdScore.PriorWeight, v) }},
+	{"score-interval", "ADSYS_SCORE_INTERVAL", "how often the adscores are recomputed from the event history",
+		func(cfg *Config, v string) error { return setDuration(&cfg.AdScore.RefreshInterval, v) }},
+	{"catalog-max-staleness", "ADSYS_CATALOG_MAX_STALENESS", "how often the in-memory catalog is reloaded from the store",
+		func(cfg *Config, v string) error { return setDuration(&cfg.Catalog.MaxStaleness, v) }},
+	{"spend-journal", "ADSYS_SPEND_JOURNAL", "local file journaling the auction charges until they are flushed",
+		func(cfg *Config, v string) error { cfg.Spend.JournalFile = v; return nil }},
+	{"spend-flush-interval", "ADSYS_SPEND_FLUSH_INTERVAL", "how often the journaled auction charges are written to the budgets",
+		func(cfg *Config, v string) error { return setDuration(&cfg.Spend.FlushInterval, v) }},
+	{"log-file", "ADSYS_LOG_FILE", "append logs to this file instead of standard error",
+		func(cfg *Config, v string) error { cfg.Log.File = v; return nil }},
+}
+
+func setDuration(d *Duration, v string) error {
+	parsed, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func setInt(i *int, v string) error {
+	parsed, err := strconv.Atoi(v)
+	if err != nil {
+		return err
+	}
+	*i = parsed
+	return nil
+}
+
+func setFloat(f *float64, v string) error {
+	parsed, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return err
+	}
+	*f = parsed
+	return nil
+}
+
+/*
+build the configuration from the defaults, the config file,
+the environment and the command line "args" (without the program name)
+return:
+	config, nil
+	invalid file / value: config, err
+*/
+func loadConfig(args []string) (Config, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet("adsys", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("ADSYS_CONFIG"), "JSON config file (env ADSYS_CONFIG)")
+	flagValues := map[string]*string{}
+	for _, setting := range configSettings {
+		flagValues[setting.flag] = fs.String(setting.flag, "", setting.usage+" (env "+setting.env+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	// config file
+	if *configFile != "" {
+		content, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			return cfg, errors.New("Failed to read config file " + *configFile)
+		}
+		if err = json.Unmarshal(content, &cfg); err != nil {
+			return cfg, errors.New("Failed to parse config file " + *configFile + ": " + err.Error())
+		}
+	}
+
+	// environment
+	for _, setting := range configSettings {
+		if v := os.Getenv(setting.env); v != "" {
+			if err := setting.set(&cfg, v); err != nil {
+				return cfg, errors.New("Invalid " + setting.env + ": " + err.Error())
+			}
+		}
+	}
+
+	// flags given on the command line
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, setting := range configSettings {
+			if setting.flag == f.Name && flagErr == nil {
+				if err := setting.set(&cfg, *flagValues[f.Name]); err != nil {
+					flagErr = errors.New("Invalid -" + f.Name + ": " + err.Error())
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return cfg, flagErr
+	}
+
+	return cfg, cfg.validate()
+}
+
+/*
+check the configuration before anything starts
+*/
+func (cfg Config) validate() error {
+	var problems []string
+	if cfg.Store != "mysql" && cfg.Store != "memory" {
+		problems = append(problems, "store must be mysql or memory")
+	}
+	if cfg.Store == "mysql" && cfg.DSN == "" {
+		problems = append(problems, "dsn is required with the mysql store")
+	} else if cfg.Store == "mysql" {
+		// the created_at, start_time and end_time columns are scanned into time.Time
+		if dsn, err := mysql.ParseDSN(cfg.DSN); err != nil {
+			problems = append(problems, "dsn is not a valid MySQL data source name: "+err.Error())
+		} else if !dsn.ParseTime {
+			problems = append(problems, "dsn must set parseTime=true")
+		}
+	}
+	if cfg.ListenAddress == "" {
+		problems = append(problems, "listen_address is required")
+	}
+	if cfg.ReadTimeout.Duration < 0 || cfg.WriteTimeout.Duration < 0 {
+		problems = append(problems, "timeouts must not be negative")
+	}
+	if cfg.DBPool.MaxOpenConns < 0 || cfg.DBPool.MaxIdleConns < 0 || cfg.DBPool.ConnMaxLifetime.Duration < 0 {
+		problems = append(problems, "db_pool limits must not be negative")
+	}
+	if _, ok := auctions[cfg.Auction.Mechanism]; !ok {
+		problems = append(problems, "auction.mechanism must be gsp, first_price or vcg")
+	}
+	if cfg.Auction.ReservePrice < 0 {
+		problems = append(problems, "auction.reserve_price must not be negative")
+	}
+	for placement, floor := range cfg.Auction.PlacementFloors {
+		if floor < 0 {
+			problems = append(problems, "auction.placement_floors."+placement+" must not be negative")
+		}
+	}
+	if cfg.Auction.VCGPositionDecay <= 0 || cfg.Auction.VCGPositionDecay > 1 {
+		problems = append(problems, "auction.vcg_position_decay must be in (0, 1]")
+	}
+	if cfg.Auction.CPAConversionRate <= 0 || cfg.Auction.CPAConversionRate > 1 {
+		problems = append(problems, "auction.cpa_conversion_rate must be in (0, 1]")
+	}
+	if cfg.Click.TTL.Duration <= 0 {
+		problems = append(problems, "click.ttl must be positive")
+	}
+	if cfg.AdScore.PriorCTR <= 0 || cfg.AdScore.PriorCTR > 1 {
+		problems = append(problems, "ad_score.prior_ctr must be in (0, 1]")
+	}
+	// an ad without impressions would score 0 / 0
+	if cfg.AdScore.PriorWeight <= 0 {
+		problems = append(problems, "ad_score.prior_weight must be positive")
+	}
+	if cfg.AdScore.RefreshInterval.Duration <= 0 {
+		problems = append(problems, "ad_score.refresh_interval must be positive")
+	}
+	if cfg.Catalog.MaxStaleness.Duration <= 0 {
+		problems = append(problems, "catalog.max_staleness must be positive")
+	}
+	if cfg.Spend.JournalFile == "" {
+		problems = append(problems, "spend.journal_file is required")
+	}
+	if cfg.Spend.FlushInterval.Duration <= 0 {
+		problems = append(problems, "spend.flush_interval must be positive")
+	}
+	if len(problems) > 0 {
+		return errors.New("Invalid config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
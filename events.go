@@ -0,0 +1,396 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// types of ad_event rows
+const (
+	eventImpression = "impression"
+	eventClick      = "click"
+	eventConversion = "conversion"
+)
+
+/*
+a new random auction id: 32 hex characters
+*/
+func newAuctionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.New("Failed to generate auction id")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+/*
+record the winners of auctions so later events can be matched to them
+a winner already recorded (an auction flushed twice) is left as it is
+*/
+func (store *mysqlStore) InsertAuctions(auctions map[string][]AuctionWinner) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return errors.New("Failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	for auctionID, winners := range auctions {
+		for _, winner := range winners {
+			ad := winner.Ad
+			if _, err = tx.Exec("INSERT IGNORE INTO auction_winner (auction_id, position, ad_id, advertiser_id, campaign_id, billing_model, price) VALUES (?, ?, ?, ?, ?, ?, ?)",
+				auctionID, winner.Position, ad.AdID, ad.AdvertiserID, nullID(ad.CampaignID), ad.BillingModel, winner.Price); err != nil {
+				return errors.New("Failed to insert into auction_winner table")
+			}
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errors.New("Failed to commit transaction")
+	}
+	return nil
+}
+
+/*
+select the winners of an auction, by position
+return:
+	no such auction: "Auction not found"
+*/
+func (store *mysqlStore) SelectAuction(auctionID string) ([]AuctionWinner, error) {
+	result, err := store.db.Query("SELECT position, ad_id, advertiser_id, campaign_id, billing_model, price FROM auction_winner WHERE auction_id = ? ORDER BY position", auctionID)
+	if err != nil {
+		return nil, errors.New("Failed to select from auction_winner table")
+	}
+	defer result.Close()
+
+	var winners []AuctionWinner
+	for result.Next() {
+		winner := AuctionWinner{AuctionID: auctionID}
+		var nilCampaignID sql.NullInt64
+		if err = result.Scan(&winner.Position, &winner.Ad.AdID, &winner.Ad.AdvertiserID, &nilCampaignID, &winner.Ad.BillingModel, &winner.Price); err != nil {
+			return nil, errors.New("Failed to convert MySQL data into AuctionWinner type")
+		}
+		winner.Ad.CampaignID = int(nilCampaignID.Int64)
+		winners = append(winners, winner)
+	}
+	if len(winners) == 0 {
+		return nil, errors.New("Auction not found")
+	}
+	return winners, nil
+}
+
+/*
+set charged_at of a winner that has not been charged yet
+return:
+	first charge: true, nil
+	already charged: false, nil
+*/
+func (store *mysqlStore) MarkCharged(auctionID string, adID int) (bool, error) {
+	result, err := store.db.Exec("UPDATE auction_winner SET charged_at = CURRENT_TIMESTAMP WHERE auction_id = ? AND ad_id = ? AND charged_at IS NULL", auctionID, adID)
+	if err != nil {
+		return false, errors.New("Failed to update auction_winner table")
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.New("Failed to update auction_winner table")
+	}
+	return n == 1, nil
+}
+
+/*
+clear charged_at of a winner
+*/
+func (store *mysqlStore) ClearCharged(auctionID string, adID int) error {
+	if _, err := store.db.Exec("UPDATE auction_winner SET charged_at = NULL WHERE auction_id = ? AND ad_id = ?", auctionID, adID); err != nil {
+		return errors.New("Failed to update auction_winner table")
+	}
+	return nil
+}
+
+/*
+add an event into ad_event table, unless the winner already has one of that type
+return:
+	added: true, nil
+	repeated event: false, nil
+*/
+func (store *mysqlStore) InsertEvent(event AdEvent) (bool, error) {
+	result, err := store.db.Exec("INSERT IGNORE INTO ad_event (auction_id, ad_id, type) VALUES (?, ?, ?)", event.AuctionID, event.AdID, event.Type)
+	if err != nil {
+		return false, errors.New("Failed to insert into ad_event table")
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.New("Failed to insert into ad_event table")
+	}
+	return n == 1, nil
+}
+
+/*
+count the impressions, clicks and conversions of an ad
+*/
+func (store *mysqlStore) SelectAdStats(adID int) (AdStats, error) {
+	stats := AdStats{AdID: adID}
+	result, err := store.db.Query("SELECT type, COUNT(*) FROM ad_event WHERE ad_id = ? GROUP BY type", adID)
+	if err != nil {
+		return stats, errors.New("Failed to select from ad_event table")
+	}
+	defer result.Close()
+
+	for result.Next() {
+		var eventType string
+		var count int64
+		if err = result.Scan(&eventType, &count); err != nil {
+			return stats, errors.New("Failed to convert MySQL data into AdStats type")
+		}
+		stats.add(eventType, count)
+	}
+	return stats, nil
+}
+
+/*
+count the impressions, clicks and conversions of every ad with events
+return:
+	ad_id ==> stats
+*/
+func (store *mysqlStore) SelectAllAdStats() (map[int]AdStats, error) {
+	result, err := store.db.Query("SELECT ad_id, type, COUNT(*) FROM ad_event GROUP BY ad_id, type")
+	if err != nil {
+		return nil, errors.New("Failed to select from ad_event table")
+	}
+	defer result.Close()
+
+	all := map[int]AdStats{}
+	for result.Next() {
+		var adID int
+		var eventType string
+		var count int64
+		if err = result.Scan(&adID, &eventType, &count); err != nil {
+			return nil, errors.New("Failed to convert MySQL data into AdStats type")
+		}
+		stats := all[adID]
+		stats.AdID = adID
+		stats.add(eventType, count)
+		all[adID] = stats
+	}
+	return all, nil
+}
+
+// add "count" events of one type to the stats
+func (stats *AdStats) add(eventType string, count int64) {
+	switch eventType {
+	case eventImpression:
+		stats.Impressions += count
+	case eventClick:
+		stats.Clicks += count
+	case eventConversion:
+		stats.Conversions += count
+	}
+}
+
+/*
+record an event of "eventType" on an ad served by an auction
+the ad must be a winner of the auction; ad_id may be left out when the auction has one winner
+the first event of each type is recorded, repeats are ignored
+the first event of the winner's billing model (click, impression or conversion) charges its advertiser,
+a billed click needs the click token served with the ad,
+a billing event that failed to be recorded or charged can be retried
+return:
+	"Event recorded" or "Duplicate <event> ignored", nil
+	err
+*/
+func (s *server) trackEvent(event AdEvent, eventType string) (string, error) {
+	// the winners of a recent auction may still be in the spend journal only
+	if err := s.spend.flushAuction(event.AuctionID); err != nil {
+		return "", err
+	}
+	winners, err := s.events.SelectAuction(event.AuctionID)
+	if err != nil {
+		return "", err
+	}
+	if event.AdID == 0 {
+		if len(winners) != 1 {
+			return "", errors.New("ad_id is required for an auction with several winners")
+		}
+		event.AdID = winners[0].Ad.AdID
+	}
+	winner, ok := findWinner(winners, event.AdID)
+	if !ok {
+		return "", errors.New("Ad did not win this auction")
+	}
+
+	// a billed click must come from the ad served: anyone knowing the auction id could charge it otherwise
+	billing := eventType == billingEvent(winner.Ad.BillingModel)
+	if billing && eventType == eventClick {
+		if err := checkClickToken(event, time.Now()); err != nil {
+			return "", err
+		}
+	}
+	event.Token = ""
+
+	// a repeated billing event on the same impression is neither recorded nor charged
+	if billing {
+		first, err := s.events.MarkCharged(event.AuctionID, event.AdID)
+		if err != nil {
+			return "", err
+		}
+		if !first {
+			return "Duplicate " + eventType + " ignored", nil
+		}
+	}
+
+	// one event of each type per winner: repeats would skew the learned adscores
+	// a billing event is only repeated here when its charge failed before, it is charged again
+	event.Type = eventType
+	added, err := s.events.InsertEvent(event)
+	if err == nil && !added && !billing {
+		return "Duplicate " + eventType + " ignored", nil
+	}
+	if err == nil && billing {
+		err = s.chargeWinner(winner)
+	}
+	if err != nil {
+		// not billed: let a retry of the event charge it
+		if billing {
+			if clearErr := s.events.ClearCharged(event.AuctionID, event.AdID); clearErr != nil {
+				log.Printf("Auction %s: ad %d marked charged but not billed: %v\n", event.AuctionID, event.AdID, clearErr)
+			}
+		}
+		return "", err
+	}
+	return "Event recorded", nil
+}
+
+/*
+response the client with the error of trackEvent
+*/
+func writeEventError(w http.ResponseWriter, err error) {
+	if err.Error() == "Auction not found" || err.Error() == "Ad did not win this auction" ||
+		err.Error() == "Advertiser not found" || err.Error() == "Campaign not found" {
+		http.Error(w, err.Error()+".", 404)
+	} else if err.Error() == "ad_id is required for an auction with several winners" {
+		http.Error(w, err.Error()+".", 400)
+	} else if err.Error() == "Invalid click token" {
+		http.Error(w, "Invalid click token.", 403)
+	} else if err.Error() == "Click token expired" {
+		http.Error(w, "Click token expired.", 410)
+	} else {
+		http.Error(w, err.Error()+".", 500)
+	}
+}
+
+/*
+decode {"auction_id": "...", "ad_id": 1} and record an event of "eventType" for it
+*/
+func (s *server) recordEvent(w http.ResponseWriter, req *http.Request, eventType string) {
+	log.Println("Received one " + eventType + " event")
+	w.Header().Set("Content-Type", "text/plain")
+
+	if req.Method != "POST" {
+		return
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	var event AdEvent
+	if err := decoder.Decode(&event); err != nil {
+		http.Error(w, "Cannot decode event's data from client", 400)
+		log.Println("Cannot decode event's data from client.", err)
+		return
+	}
+	if event.AuctionID == "" {
+		http.Error(w, "auction_id is required.", 400)
+		return
+	}
+
+	message, err := s.trackEvent(event, eventType)
+	if err != nil {
+		writeEventError(w, err)
+		return
+	}
+	w.Write([]byte(message))
+}
+
+/*
+charge the clearing price of the winner to its advertiser and campaign
+a cpm winner pays a thousandth of its price for its impression
+a budget that ran out since the auction is not charged: the event is free
+*/
+func (s *server) chargeWinner(winner AuctionWinner) error {
+	cost := billedAmount(winner.Ad, winner.Price)
+	debited, err := updateBudget(s.spend, cost, winner.Ad.AdvertiserID, winner.Ad.CampaignID, winner.Ad.AdID)
+	if err != nil {
+		return err
+	}
+	if !debited {
+		log.Printf("Auction %s: advertiser %d cannot pay %s for ad %d, %s not charged\n", winner.AuctionID, winner.Ad.AdvertiserID, cost, winner.Ad.AdID, billingEvent(winner.Ad.BillingModel))
+	}
+	return nil
+}
+
+// the winner of the auction showing "adID"
+func findWinner(winners []AuctionWinner, adID int) (AuctionWinner, bool) {
+	for _, winner := range winners {
+		if winner.Ad.AdID == adID {
+			return winner, true
+		}
+	}
+	return AuctionWinner{}, false
+}
+
+/*
+HanldeFunction
+POST /events/impression: the ad was shown
+*/
+func (s *server) handleFuncImpression(w http.ResponseWriter, req *http.Request) {
+	s.recordEvent(w, req, eventImpression)
+}
+
+/*
+HanldeFunction
+POST /events/click: the ad was clicked
+{"auction_id": "...", "ad_id": 1, "token": "..."}: the token answered with the ad (click_token) is required for a cpc ad
+*/
+func (s *server) handleFuncClick(w http.ResponseWriter, req *http.Request) {
+	s.recordEvent(w, req, eventClick)
+}
+
+/*
+HanldeFunction
+POST /events/conversion: the click led to a conversion
+*/
+func (s *server) handleFuncConversion(w http.ResponseWriter, req *http.Request) {
+	s.recordEvent(w, req, eventConversion)
+}
+
+/*
+HanldeFunction
+POST {"ad_id": 1}
+response the client with the impression, click and conversion counts of the ad
+*/
+func (s *server) handleFuncSearchAdStats(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received one ad stats request")
+	w.Header().Set("Content-Type", "text/plain")
+
+	if req.Method != "POST" {
+		return
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	var ad Ad
+	if err := decoder.Decode(&ad); err != nil {
+		http.Error(w, "Cannot decode ad's data from client", 400)
+		log.Println("Cannot decode ad's data from client.", err)
+		return
+	}
+
+	stats, err := s.events.SelectAdStats(ad.AdID)
+	if err != nil {
+		http.Error(w, err.Error()+".", 500)
+		return
+	}
+	writeJSON(w, stats)
+}
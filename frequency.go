@@ -0,0 +1,155 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+impressions served to each user, per ad and per campaign, kept in process memory
+used to cap how often one user sees the same ad or campaign
+the counts start over when the process restarts
+*/
+type frequencyCounter struct {
+	mu sync.Mutex
+	// "user/ad/7" or "user/campaign/3" ==> serving times inside the cap window
+	served map[string]*servedTimes
+}
+
+type servedTimes struct {
+	window time.Duration
+	// oldest first
+	times []time.Time
+}
+
+func newFrequencyCounter() *frequencyCounter {
+	return &frequencyCounter{served: map[string]*servedTimes{}}
+}
+
+func frequencyKey(userID, kind string, id int) string {
+	return userID + "/" + kind + "/" + strconv.Itoa(id)
+}
+
+// drop the serving times older than the window
+func (st *servedTimes) prune(now time.Time) {
+	start := now.Add(-st.window)
+	i := 0
+	for i < len(st.times) && !st.times[i].After(start) {
+		i++
+	}
+	st.times = st.times[i:]
+}
+
+/*
+whether serving the entry once more would exceed the cap
+called with the lock held
+*/
+func (c *frequencyCounter) capped(key string, cap *FrequencyCap, now time.Time) bool {
+	if cap == nil {
+		return false
+	}
+	st, ok := c.served[key]
+	if !ok {
+		return false
+	}
+	st.window = cap.Window.Duration
+	st.prune(now)
+	return len(st.times) >= cap.Impressions
+}
+
+// called with the lock held
+func (c *frequencyCounter) record(key string, cap *FrequencyCap, now time.Time) {
+	if cap == nil {
+		return
+	}
+	st, ok := c.served[key]
+	if !ok {
+		st = &servedTimes{}
+		c.served[key] = st
+	}
+	st.window = cap.Window.Duration
+	st.prune(now)
+	st.times = append(st.times, now)
+}
+
+/*
+drop the ads the user has already seen as often as the ad or its campaign allows
+an anonymous request (no user id) is never capped
+*/
+func (c *frequencyCounter) filter(ads []Ad, userID string, campaignCaps map[int]*FrequencyCap, now time.Time) []Ad {
+	if userID == "" {
+		return ads
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var allowed []Ad
+	for _, ad := range ads {
+		if c.capped(frequencyKey(userID, "ad", ad.AdID), ad.FrequencyCap, now) ||
+			(ad.CampaignID != 0 && c.capped(frequencyKey(userID, "campaign", ad.CampaignID), campaignCaps[ad.CampaignID], now)) {
+			continue
+		}
+		allowed = append(allowed, ad)
+	}
+	return allowed
+}
+
+/*
+count one impression of the ad (and its campaign) for the user
+only capped ads and campaigns are counted
+*/
+func (c *frequencyCounter) recordServed(userID string, ad Ad, campaignCap *FrequencyCap, now time.Time) {
+	if userID == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.record(frequencyKey(userID, "ad", ad.AdID), ad.FrequencyCap, now)
+	if ad.CampaignID != 0 {
+		c.record(frequencyKey(userID, "campaign", ad.CampaignID), campaignCap, now)
+	}
+}
+
+/*
+forget the users whose serving times all fell out of their windows, every "interval"
+*/
+func (c *frequencyCounter) runSweeper(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		now := time.Now()
+		c.mu.Lock()
+		for key, st := range c.served {
+			st.prune(now)
+			if len(st.times) == 0 {
+				delete(c.served, key)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+/*
+a cap needs a positive number of impressions and a window of at least one second
+*/
+func validFrequencyCap(cap *FrequencyCap) bool {
+	return cap == nil || (cap.Impressions > 0 && cap.Window.Duration >= time.Second)
+}
+
+/*
+the cap stored as two columns (0, 0: no cap)
+*/
+func frequencyCapColumns(cap *FrequencyCap) (int, int64) {
+	if cap == nil {
+		return 0, 0
+	}
+	return cap.Impressions, int64(cap.Window.Duration / time.Second)
+}
+
+func frequencyCapFromColumns(impressions int, windowSeconds int64) *FrequencyCap {
+	if impressions <= 0 {
+		return nil
+	}
+	return &FrequencyCap{Impressions: impressions, Window: Duration{time.Duration(windowSeconds) * time.Second}}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+/*
+inverted index of the active ads over the include lists of their targeting
+one dimension per request context field:
+	value ==> ads listing that value
+	open: ads without an include list on the dimension (they take any value)
+*/
+type indexDimension struct {
+	postings map[string]map[int]bool
+	open     map[int]bool
+}
+
+func newIndexDimension() *indexDimension {
+	return &indexDimension{postings: map[string]map[int]bool{}, open: map[int]bool{}}
+}
+
+func (d *indexDimension) add(adID int, include []string) {
+	if len(include) == 0 {
+		d.open[adID] = true
+		return
+	}
+	for _, value := range include {
+		if d.postings[value] == nil {
+			d.postings[value] = map[int]bool{}
+		}
+		d.postings[value][adID] = true
+	}
+}
+
+func (d *indexDimension) remove(adID int, include []string) {
+	delete(d.open, adID)
+	for _, value := range include {
+		delete(d.postings[value], adID)
+		if len(d.postings[value]) == 0 {
+			delete(d.postings, value)
+		}
+	}
+}
+
+// whether the ad accepts one of the request values
+func (d *indexDimension) accepts(adID int, values []string) bool {
+	if d.open[adID] {
+		return true
+	}
+	for _, value := range values {
+		if d.postings[value][adID] {
+			return true
+		}
+	}
+	return false
+}
+
+// number of ads accepting one of the request values (an upper bound when values overlap)
+func (d *indexDimension) size(values []string) int {
+	n := len(d.open)
+	for _, value := range values {
+		n += len(d.postings[value])
+	}
+	return n
+}
+
+// the ads accepting one of the request values
+func (d *indexDimension) each(values []string, f func(adID int)) {
+	for adID := range d.open {
+		f(adID)
+	}
+	for _, value := range values {
+		for adID := range d.postings[value] {
+			if !d.open[adID] {
+				f(adID)
+			}
+		}
+	}
+}
+
+/*
+the active ads and their inverted index
+candidate retrieval walks the smallest matching posting lists instead of the whole catalog
+*/
+type adIndex struct {
+	mu         sync.RWMutex
+	ads        map[int]Ad
+	dimensions map[string]*indexDimension
+}
+
+// the request context fields the index is built on
+var indexedFields = []string{"geo", "device", "language", "category", "keywords"}
+
+func newAdIndex() *adIndex {
+	index := &adIndex{ads: map[int]Ad{}, dimensions: map[string]*indexDimension{}}
+	for _, field := range indexedFields {
+		index.dimensions[field] = newIndexDimension()
+	}
+	return index
+}
+
+// include list of the ad's targeting on one field
+func targetingInclude(t *Targeting, field string) []string {
+	if t == nil {
+		return nil
+	}
+	switch field {
+	case "geo":
+		return t.Geos
+	case "device":
+		return t.Devices
+	case "language":
+		return t.Languages
+	case "category":
+		return t.Categories
+	default:
+		return t.Keywords
+	}
+}
+
+// request values of one field
+func contextValues(ctx RequestContext, field string) []string {
+	var value string
+	switch field {
+	case "geo":
+		value = ctx.Geo
+	case "device":
+		value = ctx.Device
+	case "language":
+		value = ctx.Language
+	case "category":
+		value = ctx.Category
+	default:
+		return ctx.Keywords
+	}
+	if value == "" {
+		return nil
+	}
+	return []string{value}
+}
+
+/*
+add the ad, or replace it when it is already indexed
+*/
+func (index *adIndex) put(ad Ad) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	index.removeLocked(ad.AdID)
+	index.ads[ad.AdID] = ad
+	for _, field := range indexedFields {
+		index.dimensions[field].add(ad.AdID, targetingInclude(ad.Targeting, field))
+	}
+}
+
+func (index *adIndex) remove(adID int) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	index.removeLocked(adID)
+}
+
+func (index *adIndex) removeLocked(adID int) {
+	old, ok := index.ads[adID]
+	if !ok {
+		return
+	}
+	for _, field := range indexedFields {
+		index.dimensions[field].remove(adID, targetingInclude(old.Targeting, field))
+	}
+	delete(index.ads, adID)
+}
+
+/*
+replace the whole index with "ads"
+*/
+func (index *adIndex) load(ads []Ad) {
+	fresh := newAdIndex()
+	for _, ad := range ads {
+		fresh.put(ad)
+	}
+
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	index.ads, index.dimensions = fresh.ads, fresh.dimensions
+}
+
+/*
+set the adscores of the indexed ads
+*/
+func (index *adIndex) setScores(scores map[int]float64) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	for adID, score := range scores {
+		if ad, ok := index.ads[adID]; ok {
+			ad.AdScore = score
+			index.ads[adID] = ad
+		}
+	}
+}
+
+/*
+the active ads whose targeting accepts the request context, in ad_id order
+start from the dimension with the fewest matching ads and check the others per ad,
+then apply the exclude lists and hours of the ads left
+*/
+func (index *adIndex) candidates(ctx RequestContext) []Ad {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	smallest := indexedFields[0]
+	for _, field := range indexedFields[1:] {
+		if index.dimensions[field].size(contextValues(ctx, field)) < index.dimensions[smallest].size(contextValues(ctx, smallest)) {
+			smallest = field
+		}
+	}
+
+	var matching []Ad
+	seen := map[int]bool{}
+	index.dimensions[smallest].each(contextValues(ctx, smallest), func(adID int) {
+		if seen[adID] {
+			return
+		}
+		seen[adID] = true
+		for _, field := range indexedFields {
+			if field != smallest && !index.dimensions[field].accepts(adID, contextValues(ctx, field)) {
+				return
+			}
+		}
+		if ad := index.ads[adID]; ad.Targeting.matches(ctx) {
+			matching = append(matching, ad)
+		}
+	})
+
+	// same order as the database: ties in the auction keep it
+	sort.Slice(matching, func(i, j int) bool {
+		return matching[i].AdID < matching[j].AdID
+	})
+	return matching
+}
+
+/*
+AdStore that keeps the index of the active ads in sync with every change made through it
+*/
+type indexedAdStore struct {
+	AdStore
+	index *adIndex
+}
+
+/*
+wrap "store" and index its active ads
+*/
+func newIndexedAdStore(store AdStore) (*indexedAdStore, error) {
+	ads, err := store.SelectActiveAds()
+	if err != nil {
+		return nil, err
+	}
+	index := newAdIndex()
+	index.load(ads)
+	return &indexedAdStore{AdStore: store, index: index}, nil
+}
+
+/*
+index the ad when it becomes active, drop it when it leaves active
+*/
+func (store *indexedAdStore) reindex(adID int) error {
+	ad, err := store.AdStore.SelectAd(adID)
+	if err != nil {
+		if err.Error() == "Ad not found" {
+			store.index.remove(adID)
+			return nil
+		}
+		return err
+	}
+	if ad.Status == adStatusActive {
+		store.index.put(ad)
+	} else {
+		store.index.remove(adID)
+	}
+	return nil
+}
+
+func (store *indexedAdStore) SetAdStatus(adID int, from, to string) (bool, error) {
+	moved, err := store.AdStore.SetAdStatus(adID, from, to)
+	if err != nil || !moved {
+		return moved, err
+	}
+	return true, store.reindex(adID)
+}
+
+func (store *indexedAdStore) ReviewAd(review AdReview) (bool, error) {
+	recorded, err := store.AdStore.ReviewAd(review)
+	if err != nil || !recorded {
+		return recorded, err
+	}
+	return true, store.reindex(review.AdID)
+}
+
+func (store *indexedAdStore) DeleteAd(adID int) error {
+	if err := store.AdStore.DeleteAd(adID); err != nil {
+		return err
+	}
+	store.index.remove(adID)
+	return nil
+}
+
+func (store *indexedAdStore) UpdateAdScores(scores map[int]float64) error {
+	if err := store.AdStore.UpdateAdScores(scores); err != nil {
+		return err
+	}
+	store.index.setScores(scores)
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+func TestAdIndexCandidates(t *testing.T) {
+	index := newAdIndex()
+	index.load([]Ad{
+		{AdID: 1},
+		{AdID: 2, Targeting: &Targeting{Geos: []string{"us"}}},
+		{AdID: 3, Targeting: &Targeting{Geos: []string{"fr"}, Devices: []string{"mobile"}}},
+		{AdID: 4, Targeting: &Targeting{Geos: []string{"us", "ca"}, ExcludeDevices: []string{"mobile"}}},
+		{AdID: 5, Targeting: &Targeting{Keywords: []string{"shoes"}}},
+		{AdID: 6, Targeting: &Targeting{Hours: []int{9, 10}}},
+	})
+
+	tests := []struct {
+		name string
+		ctx  RequestContext
+		want []int
+	}{
+		{"empty context", RequestContext{}, []int{1}},
+		{"geo", RequestContext{Geo: "us"}, []int{1, 2, 4}},
+		{"second value of an include list", RequestContext{Geo: "ca"}, []int{1, 4}},
+		{"exclude list", RequestContext{Geo: "us", Device: "mobile"}, []int{1, 2}},
+		{"two include lists", RequestContext{Geo: "fr", Device: "mobile"}, []int{1, 3}},
+		{"include list not matched", RequestContext{Geo: "de", Device: "mobile"}, []int{1}},
+		{"keywords", RequestContext{Geo: "us", Keywords: []string{"hats", "shoes"}}, []int{1, 2, 4, 5}},
+		{"hours", RequestContext{Hour: 9}, []int{1, 6}},
+	}
+	for _, tt := range tests {
+		var got []int
+		for _, ad := range index.candidates(tt.ctx) {
+			got = append(got, ad.AdID)
+		}
+		if !sameIDs(got, tt.want) {
+			t.Errorf("%s: candidates = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// a replaced ad is found under its new targeting only, a removed one is gone
+	index.put(Ad{AdID: 2, Targeting: &Targeting{Geos: []string{"fr"}}})
+	index.remove(4)
+	if got := index.candidates(RequestContext{Geo: "us"}); len(got) != 1 || got[0].AdID != 1 {
+		t.Errorf("after put and remove: candidates = %v, want ad 1 only", got)
+	}
+}
+
+func sameIDs(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
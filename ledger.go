@@ -0,0 +1,134 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// types of budget_transaction rows
+const (
+	transactionTopUp         = "top_up"
+	transactionAuctionCharge = "auction_charge"
+	transactionRefund        = "refund"
+	transactionAdjustment    = "adjustment"
+	// budget moved into (or out of) a campaign: the campaign budget changes, the advertiser balance does not
+	transactionCampaignBudget = "campaign_budget"
+)
+
+/*
+select the budget transactions of an advertiser created in [from, to)
+a zero from / to leaves that side of the range open
+return:
+	transactions ordered by time, oldest first
+*/
+func (store *mysqlStore) SelectBudgetTransactions(advertiserID int, from, to time.Time) ([]BudgetTransaction, error) {
+	query := "SELECT transaction_id, advertiser_id, type, amount, ad_id, campaign_id, created_at, balance_after, charged_at FROM budget_transaction WHERE advertiser_id = ?"
+	args := []interface{}{advertiserID}
+	if !from.IsZero() {
+		query += " AND created_at >= ?"
+		args = append(args, from)
+	}
+	if !to.IsZero() {
+		query += " AND created_at < ?"
+		args = append(args, to)
+	}
+	query += " ORDER BY created_at, transaction_id"
+
+	result, err := store.db.Query(query, args...)
+	if err != nil {
+		return nil, errors.New("Failed to select from budget_transaction table")
+	}
+	defer result.Close()
+
+	var transactions []BudgetTransaction
+	for result.Next() {
+		var t BudgetTransaction
+		var nilAdID, nilCampaignID sql.NullInt64
+		if err = result.Scan(&t.TransactionID, &t.AdvertiserID, &t.Type, &t.Amount, &nilAdID, &nilCampaignID, &t.CreatedAt, &t.BalanceAfter, &t.ChargedAt); err != nil {
+			return nil, errors.New("Failed to convert MySQL data into BudgetTransaction type")
+		}
+		t.AdID = int(nilAdID.Int64)
+		t.CampaignID = int(nilCampaignID.Int64)
+		transactions = append(transactions, t)
+	}
+	return transactions, nil
+}
+
+/*
+parse a date range bound: RFC 3339 time or YYYY-MM-DD date
+an empty string is the zero time
+*/
+func parseTimeBound(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+/*
+HanldeFunction
+GET /advertisers/{id}/transactions?from=&to=
+response the client with the ledger of the advertiser in the date range
+*/
+func (s *server) handleFuncAdvertiserTransactions(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received one budget transactions request")
+	w.Header().Set("Content-Type", "text/plain")
+
+	if req.Method != "GET" {
+		return
+	}
+
+	// path: /advertisers/{id}/transactions
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(parts) != 3 || parts[2] != "transactions" {
+		http.NotFound(w, req)
+		return
+	}
+	advertiserID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		http.Error(w, "Advertiser id must be an integer.", 400)
+		return
+	}
+
+	from, err := parseTimeBound(req.URL.Query().Get("from"))
+	if err != nil {
+		http.Error(w, "from must be a date (YYYY-MM-DD) or RFC 3339 time.", 400)
+		return
+	}
+	to, err := parseTimeBound(req.URL.Query().Get("to"))
+	if err != nil {
+		http.Error(w, "to must be a date (YYYY-MM-DD) or RFC 3339 time.", 400)
+		return
+	}
+
+	transactions, err := s.advertisers.SelectBudgetTransactions(advertiserID, from, to)
+	if err != nil {
+		if err.Error() == "Failed to connect the database" {
+			http.Error(w, "Failed to connect the database.", 500)
+		} else if err.Error() == "Failed to select from budget_transaction table" {
+			http.Error(w, "Failed to select from budget_transaction table.", 500)
+		} else if err.Error() == "Failed to convert MySQL data into BudgetTransaction type" {
+			http.Error(w, "Failed to convert MySQL data into BudgetTransaction type.", 500)
+		}
+		return
+	}
+
+	// convert the transactions into Json format
+	transactionsJSON, err := json.Marshal(transactions)
+	if err != nil {
+		http.Error(w, "Failed to parse transactions into JSON format", 500)
+		log.Printf("Failed to parse transactions into JSON format %v.\n", err)
+		return
+	}
+
+	w.Write(transactionsJSON)
+}
@@ -1,40 +1,180 @@
 package main
 
 import (
-	"database/sql"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"log"
+	"math/rand"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 )
 
+// default dsn, override with -dsn, ADSYS_DSN or "dsn" in the config file
 const (
-	mysqlDataSourceName = "root:root@tcp(www.fyz34.com:9500)/ad_sys"
+	mysqlDataSourceName = "root:root@tcp(www.fyz34.com:9500)/ad_sys?parseTime=true"
 	// mysqlDataSourceName = "root:root@(localhost:3306)/AdSysGo"
 )
 
+// server holds the stores the handlers read and write
+type server struct {
+	ads         AdStore
+	advertisers AdvertiserStore
+	campaigns   CampaignStore
+	events      EventStore
+	frequency   *frequencyCounter
+	// active ads indexed on their targeting, kept in sync by "ads"
+	index *adIndex
+	// ad groups, campaigns and budgets read by the auctions, kept in sync by "campaigns" and "advertisers"
+	catalog *catalog
+	// auction charges on their way to the budgets in the store
+	spend *spendWriter
+}
+
 // Advertiser type
 type Advertiser struct {
-	AdvertiserID int     `json:"advertiser_id"`
-	Name         string  `json:"name"`
-	Budget       float64 `json:"budget"`
+	AdvertiserID int    `json:"advertiser_id"`
+	Name         string `json:"name"`
+	Budget       Money  `json:"budget"`
+	// most the advertiser spends per day (0: no cap), spread over the day by pacing: even or asap
+	DailyBudget Money  `json:"daily_budget"`
+	Pacing      string `json:"pacing"`
 }
 
 // Ad type
 type Ad struct {
 	AdID         int     `json:"ad_id"`
-	Bid          float64 `json:"bid"`
+	Bid          Money   `json:"bid"`
 	ImageURL     string  `json:"image_url"`
+	LandingURL   string  `json:"landing_url"`
 	AdvertiserID int     `json:"advertiser_id"`
-	AdScore      float64 `json:"ad_score"`
+	AdScore      float64 `json:"ad_score"` // learned ctr estimate, the client's value is ignored
+	AdGroupID    int     `json:"ad_group_id,omitempty"`
+	// cpc (default), cpm or cpa: what the bid pays for
+	BillingModel string `json:"billing_model"`
+	// pending_review, active, paused, rejected or archived: only active ads serve
+	Status string `json:"status"`
+	// at most this many impressions per user
+	FrequencyCap *FrequencyCap `json:"frequency_cap,omitempty"`
+	// audience and context the ad is shown to; nil: every request
+	Targeting *Targeting `json:"targeting,omitempty"`
+	// campaign of the ad group, resolved for the auction (not stored on the ad)
+	CampaignID int `json:"campaign_id,omitempty"`
+}
+
+// Targeting type: include / exclude lists matched against the RequestContext of an auction
+// an empty include list accepts any value, values are compared case-insensitively
+type Targeting struct {
+	Geos              []string `json:"geos,omitempty"`
+	ExcludeGeos       []string `json:"exclude_geos,omitempty"`
+	Devices           []string `json:"devices,omitempty"`
+	ExcludeDevices    []string `json:"exclude_devices,omitempty"`
+	Languages         []string `json:"languages,omitempty"`
+	ExcludeLanguages  []string `json:"exclude_languages,omitempty"`
+	Keywords          []string `json:"keywords,omitempty"`
+	ExcludeKeywords   []string `json:"exclude_keywords,omitempty"`
+	Categories        []string `json:"categories,omitempty"`
+	ExcludeCategories []string `json:"exclude_categories,omitempty"`
+	// hours of the day (0-23)
+	Hours []int `json:"hours,omitempty"`
+}
+
+// FrequencyCap type: at most Impressions impressions to one user within Window
+type FrequencyCap struct {
+	Impressions int      `json:"impressions"`
+	Window      Duration `json:"window"`
+}
+
+// Campaign type
+// budget, schedule and targeting of a line of business
+type Campaign struct {
+	CampaignID   int        `json:"campaign_id"`
+	AdvertiserID int        `json:"advertiser_id"`
+	Name         string     `json:"name"`
+	Budget       Money      `json:"budget"`
+	StartTime    *time.Time `json:"start_time,omitempty"`
+	EndTime      *time.Time `json:"end_time,omitempty"`
+	Placements   []string   `json:"placements,omitempty"`
+	Paused       bool       `json:"paused"`
+	// at most this many impressions of the campaign's ads per user
+	FrequencyCap *FrequencyCap `json:"frequency_cap,omitempty"`
+	// rules every ad of the campaign must match as well as its own
+	Targeting *Targeting `json:"targeting,omitempty"`
+	// most the campaign spends per day (0: no cap), spread over the day by pacing: even or asap
+	DailyBudget Money  `json:"daily_budget"`
+	Pacing      string `json:"pacing"`
+}
+
+// AdGroup type
+type AdGroup struct {
+	AdGroupID  int    `json:"ad_group_id"`
+	CampaignID int    `json:"campaign_id"`
+	Name       string `json:"name"`
+	DefaultBid Money  `json:"default_bid"`
+	Paused     bool   `json:"paused"`
+}
+
+// AdReview type: one moderation decision on an ad
+type AdReview struct {
+	ReviewID  int       `json:"review_id"`
+	AdID      int       `json:"ad_id"`
+	Decision  string    `json:"decision"`
+	Reason    string    `json:"reason,omitempty"`
+	Reviewer  string    `json:"reviewer"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AdEvent type: an impression, click or conversion on an ad served by an auction
+type AdEvent struct {
+	EventID   int       `json:"event_id"`
+	AuctionID string    `json:"auction_id"`
+	AdID      int       `json:"ad_id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	// click token of the served ad: required on the click of a cpc ad, not stored
+	Token string `json:"token,omitempty"`
+}
+
+// AdStats type: event counts of an ad
+type AdStats struct {
+	AdID        int   `json:"ad_id"`
+	Impressions int64 `json:"impressions"`
+	Clicks      int64 `json:"clicks"`
+	Conversions int64 `json:"conversions"`
+}
+
+// ChosenAd type: the ad answered by /chooseAd, the auction id its events refer to
+// and the signed tracking url to send its clicks through
+type ChosenAd struct {
+	Ad
+	AuctionID  string `json:"auction_id"`
+	ClickToken string `json:"click_token"`
+	ClickURL   string `json:"click_url,omitempty"`
 }
 
 // AddBudgetProcess type
 type AddBudgetProcess struct {
-	AdvertiserID int     `json:"advertiser_id"`
-	AddBudget    float64 `json:"add_budget"`
+	AdvertiserID int    `json:"advertiser_id"`
+	AddBudget    Money  `json:"add_budget"`
+	Type         string `json:"type"`
+	AdID         int    `json:"ad_id"`
+}
+
+// BudgetTransaction type
+type BudgetTransaction struct {
+	TransactionID int       `json:"transaction_id"`
+	AdvertiserID  int       `json:"advertiser_id"`
+	Type          string    `json:"type"`
+	Amount        Money     `json:"amount"`
+	AdID          int       `json:"ad_id,omitempty"`
+	CampaignID    int       `json:"campaign_id,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	BalanceAfter  Money     `json:"balance_after"`
+	// auction charges: when the charge was made, created_at is when the spend writer flushed it
+	ChargedAt *time.Time `json:"charged_at,omitempty"`
 }
 
 // SearchAdvertiserProcess type
@@ -48,178 +188,238 @@ type SearchAdsByAdvertiserIDProcess struct {
 }
 
 /*
-select all ads from database
-convert each ad into type Ad
+charge "cost" to the budget of the chosen advertiser, and of its campaign when campaignID is not 0
+the budgets are checked and debited in the catalog and the charge journaled,
+the store is debited by the next flush of the spend writer
 return:
-	a slice of type Ad
+	debited: true, nil
+	budget would go below zero: false, nil
+	other error: false, err
 */
-func selectAllAds() ([]Ad, error) {
-	// connect to MySQL database
-	db, err := sql.Open("mysql", mysqlDataSourceName)
-	if err != nil {
-		return nil, errors.New("Failed to connect the database")
-	}
-	defer db.Close()
-
-	// select all ads and save them into a slice of type Ad
-	var Ads []Ad
-	result, err := db.Query("SELECT * FROM ad")
-	if err != nil {
-		return nil, errors.New("Failed to select all the ads from MySQL database")
-	}
-	defer result.Close()
-
-	for result.Next() {
-		var ad Ad
-		// deal with possible Null values from database
-		// if null bid / score ==> 0
-		// if null imageuURL ==> ""
-		var nilURL []byte
-		var nilBid, nilAdScore sql.NullFloat64
-		err = result.Scan(&ad.AdID, &nilBid, &nilURL, &ad.AdvertiserID, &nilAdScore)
-		if err != nil {
-			return nil, errors.New("Failed to convert MySQL data into Ad type")
-		}
-		ad.ImageURL = string(nilURL)
-		ad.Bid = nilBid.Float64
-		ad.AdScore = nilAdScore.Float64
-		Ads = append(Ads, ad)
-	}
-	return Ads, nil
+func updateBudget(spend *spendWriter, cost Money, advertiserID int, campaignID int, adID int) (bool, error) {
+	return spend.charge(advertiserID, campaignID, adID, cost)
 }
 
 /*
-update the budget of the chosen advertiser
-return
+rank the ads clearing the floor of ?placement= and the reserve price, and get the top one
+skip the ads ?user_id= has already seen as often as their frequency caps allow
+skip the ads whose targeting rejects the request context (?geo= &device= &lang= &keywords= &category= &hour=)
+price it with the auction named by ?mechanism= (default: defaultAuctionMechanism)
+skip the ads held back by their ad group / campaign and those whose advertisers or campaigns cannot pay
+(out of budget or of daily budget); those spending ahead of even pacing take part with a lower probability
+no ad clears the floor: response 204 with an empty body
+the advertiser is charged when the event of the ad's billing model is reported
+response the client with the chosen ad data and the auction_id to report its events with
 */
-func updateBudget(cost float64, advertiserID int) error {
-	// connect to database
-	db, err := sql.Open("mysql", mysqlDataSourceName)
+func (s *server) handleFuncChooseAd(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received one request for choosing an ad")
+	w.Header().Set("Content-Type", "text/plain")
+
+	if req.Method != "GET" {
+		return
+	}
+
+	auction, err := getAuction(req.URL.Query().Get("mechanism"))
 	if err != nil {
-		return errors.New("Failed to connect the database")
+		http.Error(w, "Unknown auction mechanism.", 400)
+		return
 	}
-	defer db.Close()
 
-	// select advertiser with advertiserID
-	sele, err := db.Query("SELECT budget FROM advertiser WHERE advertiser_id=(?)", advertiserID)
+	request, err := parseAuctionRequest(req.URL.Query(), 1, time.Now())
 	if err != nil {
-		return errors.New("Failed to select from advertiser table")
+		http.Error(w, err.Error()+".", 400)
+		return
 	}
-	defer sele.Close()
 
-	// get old budget from selected result
-	var newBudget float64
-	for sele.Next() {
-		var nilBudget sql.NullFloat64
-		if err = sele.Scan(&nilBudget); err != nil {
-			return errors.New("Failed to get old budget")
-		}
-		newBudget = nilBudget.Float64 - cost
+	// rank the ads clearing the placement floor and the reserve price
+	// price the top one with the chosen auction mechanism
+	winners, err := s.runAuction(auction, request)
+	if err != nil {
+		writeAuctionError(w, err)
+		return
+	}
+	if len(winners) == 0 {
+		writeNoFill(w)
+		return
 	}
+	ad1 := ChosenAd{Ad: winners[0].Ad, AuctionID: winners[0].AuctionID, ClickToken: winners[0].ClickToken, ClickURL: winners[0].ClickURL}
 
-	// update old budget with new budget
-	update, err := db.Query("UPDATE advertiser SET budget=(?) WHERE advertiser_id=(?)", newBudget, advertiserID)
+	// convert chosen ad data into Json format
+	topAdJSON, err := json.Marshal(ad1)
 	if err != nil {
-		return errors.New("Failed to update budget")
+		http.Error(w, "Failed to parse allAds into JSON format", 500)
+		log.Printf("Failed to parse allAds into JSON format %v.\n", err)
+		return
 	}
-	defer update.Close()
 
-	return nil
+	// write the chosen ad json to response
+	w.Write(topAdJSON)
 
 }
 
-/*
-rank all ads and get the top two
-use second-place ad to compute the cpc price of the top-ranked ad
-update the budget of the advertiser
-response the client with the chosen ad data
-*/
-func handleFuncChooseAd(w http.ResponseWriter, req *http.Request) {
-	fmt.Println("Received one request for choosing an ad")
-	w.Header().Set("Content-Type", "text/plain")
-
-	if req.Method != "GET" {
+func main() {
+	// go run *.go migrate up|down|status
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrateMain(os.Args[2:])
 		return
 	}
 
-	// allAds : a slice of Ad type including all the ads
-	allAds, err := selectAllAds()
+	cfg, err := loadConfig(os.Args[1:])
 	if err != nil {
-		if err.Error() == "Failed to connect the database" {
-			http.Error(w, "Failed to connect the database.", 500)
-		} else if err.Error() == "Failed to select all the ads from MySQL database" {
-			http.Error(w, "Failed to select all the ads from MySQL database.", 500)
-		} else if err.Error() == "Failed to convert MySQL data into Ad type" {
-			http.Error(w, "Failed to convert MySQL data into Ad type.", 500)
-		}
-		return
+		fmt.Println(err)
+		os.Exit(2)
 	}
 
-	// select the top two ads (chosen by bid * adscore)
-	if len(allAds) < 2 {
-		http.Error(w, "No enough ads in database.", 400)
+	// logging
+	log.SetFlags(log.LstdFlags)
+	if cfg.Log.Microseconds {
+		log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 	}
-
-	var ad1, ad2 Ad
-	if allAds[0].Bid*allAds[0].AdScore >= allAds[1].Bid*allAds[1].AdScore {
-		ad1, ad2 = allAds[0], allAds[1]
-	} else {
-		ad1, ad2 = allAds[1], allAds[0]
+	if cfg.Log.File != "" {
+		logFile, err := os.OpenFile(cfg.Log.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			fmt.Println("Failed to open log file", err)
+			os.Exit(1)
+		}
+		defer logFile.Close()
+		log.SetOutput(logFile)
 	}
 
-	for i := 2; i < len(allAds); i++ {
-		if allAds[i].Bid*allAds[i].AdScore > ad1.Bid*ad1.AdScore {
-			ad1 = allAds[i]
-		} else if allAds[i].Bid*allAds[i].AdScore > ad2.Bid*ad2.AdScore {
-			ad2 = allAds[i]
+	// auction parameters
+	defaultAuctionMechanism = cfg.Auction.Mechanism
+	reservePrice = cfg.Auction.ReservePrice
+	placementFloors = cfg.Auction.PlacementFloors
+	auctions["vcg"] = vcgAuction{positionDecay: cfg.Auction.VCGPositionDecay}
+	conversionRate = cfg.Auction.CPAConversionRate
+
+	// click tracking urls
+	clickSecret = []byte(cfg.Click.Secret)
+	if len(clickSecret) == 0 {
+		log.Println("No click secret configured: click urls will not survive a restart")
+		if clickSecret, err = randomClickSecret(); err != nil {
+			log.Println(err)
+			os.Exit(1)
 		}
 	}
+	clickTTL = cfg.Click.TTL.Duration
+	clickBaseURL = strings.TrimSuffix(cfg.Click.BaseURL, "/")
 
-	// compute CPC of first advertisement
-	cost := ad2.Bid*ad2.AdScore/ad1.AdScore + 0.01
-	// update budget of corresponding advertiser
-	if err := updateBudget(cost, ad1.AdvertiserID); err != nil {
-		if err.Error() == "Failed to connect the database" {
-			http.Error(w, "Failed to connect the database.", 500)
-		} else if err.Error() == "Failed to select from advertiser table" {
-			http.Error(w, "Failed to select from advertiser table.", 500)
-		} else if err.Error() == "Failed to get old budget" {
-			http.Error(w, "Failed to get old budget.", 500)
-		} else if err.Error() == "Failed to update budget" {
-			http.Error(w, "Failed to update budget.", 500)
+	// every handler shares the same stores
+	var s *server
+	switch cfg.Store {
+	case "mysql":
+		pool := DBPoolConfig{
+			MaxOpenConns:    cfg.DBPool.MaxOpenConns,
+			MaxIdleConns:    cfg.DBPool.MaxIdleConns,
+			ConnMaxLifetime: cfg.DBPool.ConnMaxLifetime.Duration,
+		}
+		store, err := newMySQLStore(cfg.DSN, pool)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
 		}
+		defer store.Close()
+		s = &server{ads: store, advertisers: store, campaigns: store, events: store}
+	case "memory":
+		store := newMemoryStore()
+		s = &server{ads: store, advertisers: store, campaigns: store, events: store}
+	}
+	// candidate retrieval from the in-memory index instead of the ad table
+	indexed, err := newIndexedAdStore(s.ads)
+	if err != nil {
+		log.Println("Failed to index the active ads:", err)
+		os.Exit(1)
 	}
+	s.ads, s.index = indexed, indexed.index
 
-	// convert chosen ad data into Json format
-	topAdJSON, err := json.Marshal(ad1)
+	// auction charges and winners are journaled locally and written to the store in batches
+	// the batches a crash left behind are written before the budgets are read
+	s.spend, err = newSpendWriter(cfg.Spend.JournalFile, s.advertisers, s.events)
 	if err != nil {
-		http.Error(w, "Failed to parse allAds into JSON format", 500)
-		fmt.Printf("Failed to parse allAds into JSON format %v.\n", err)
-		return
+		log.Println("Failed to open the spend journal:", err)
+		os.Exit(1)
+	}
+	if err = s.spend.flush(); err != nil {
+		log.Println("Failed to flush the spend journal:", err)
 	}
 
-	// write the chosen ad json to response
-	w.Write(topAdJSON)
+	// auctions read the rest of the catalog from memory as well
+	s.catalog, err = newCatalog(s.campaigns, s.advertisers, s.spend)
+	if err != nil {
+		log.Println("Failed to load the catalog:", err)
+		os.Exit(1)
+	}
+	s.spend.catalog = s.catalog
+	go s.spend.runFlusher(cfg.Spend.FlushInterval.Duration)
+	s.campaigns = &cachedCampaignStore{CampaignStore: s.campaigns, catalog: s.catalog}
+	s.advertisers = &cachedAdvertiserStore{AdvertiserStore: s.advertisers, catalog: s.catalog}
+	go s.runCatalogRefresher(cfg.Catalog.MaxStaleness.Duration)
 
-}
+	// pacing draws who takes part in an auction
+	rand.Seed(time.Now().UnixNano())
 
-func main() {
-	fmt.Println("Start Ad System")
+	s.frequency = newFrequencyCounter()
+	go s.frequency.runSweeper(time.Minute)
+
+	// adscores follow the observed click-through rates
+	adScorePrior = adScoreModel{priorCTR: cfg.AdScore.PriorCTR, priorWeight: cfg.AdScore.PriorWeight}
+	go s.runAdScoreJob(cfg.AdScore.RefreshInterval.Duration)
+
+	log.Println("Start Ad System on", cfg.ListenAddress)
 
 	// handler1: post: add advertiser into db
-	http.HandleFunc("/addAdvertiser", handleFuncAddAdvertiser)
+	http.HandleFunc("/addAdvertiser", s.handleFuncAddAdvertiser)
 	// handler2: post: add ad into db
-	http.HandleFunc("/addAd", handleFuncAddAd)
-	// handler3: get: retrieve top ranked ad from db and update dudget of the advertiser
-	http.HandleFunc("/chooseAd", handleFuncChooseAd)
+	http.HandleFunc("/addAd", s.handleFuncAddAd)
+	// handler3: get: retrieve top ranked ad from db, its advertiser pays on click / impression / conversion
+	http.HandleFunc("/chooseAd", s.handleFuncChooseAd)
 	// handler4: post: add budget of an advertiser
-	http.HandleFunc("/addBudget", handleFuncAddBudget)
+	http.HandleFunc("/addBudget", s.handleFuncAddBudget)
 	// handler5: post: search an advertiser with name
-	http.HandleFunc("/searchAdvertiser", handleFuncSearchAdvertiser)
+	http.HandleFunc("/searchAdvertiser", s.handleFuncSearchAdvertiser)
 	// handler6: post: select all ads with with advertiser_id
-	http.HandleFunc("/searchAdsByAdvertiserID", handleFuncSearchAdsByAdvertiserID)
+	http.HandleFunc("/searchAdsByAdvertiserID", s.handleFuncSearchAdsByAdvertiserID)
 	// handler7: post: delete an ad with ad_id
-	http.HandleFunc("/deleteAd", handleFuncDeleteAd)
+	http.HandleFunc("/deleteAd", s.handleFuncDeleteAd)
+	// handler8: get: retrieve top N ranked ads (?slots=N), each advertiser pays on its billing event
+	http.HandleFunc("/chooseAds", s.handleFuncChooseAds)
+	// handler9: get: budget transactions of an advertiser (/advertisers/{id}/transactions?from=&to=)
+	http.HandleFunc("/advertisers/", s.handleFuncAdvertiserTransactions)
+	// handler10-13: post: add / update / delete a campaign, search the campaigns of an advertiser_id
+	http.HandleFunc("/addCampaign", s.handleFuncAddCampaign)
+	http.HandleFunc("/updateCampaign", s.handleFuncUpdateCampaign)
+	http.HandleFunc("/deleteCampaign", s.handleFuncDeleteCampaign)
+	http.HandleFunc("/searchCampaigns", s.handleFuncSearchCampaigns)
+	// handler14-17: post: add / update / delete an ad group, search the ad groups of a campaign_id
+	http.HandleFunc("/addAdGroup", s.handleFuncAddAdGroup)
+	http.HandleFunc("/updateAdGroup", s.handleFuncUpdateAdGroup)
+	http.HandleFunc("/deleteAdGroup", s.handleFuncDeleteAdGroup)
+	http.HandleFunc("/searchAdGroups", s.handleFuncSearchAdGroups)
+	// handler18: post: move an ad to another status (active, paused, archived)
+	http.HandleFunc("/updateAdStatus", s.handleFuncUpdateAdStatus)
+	// handler19: get: the ads waiting for review
+	http.HandleFunc("/pendingAds", s.handleFuncPendingAds)
+	// handler20: post: approve or reject a pending ad
+	http.HandleFunc("/reviewAd", s.handleFuncReviewAd)
+	// handler21: post: review history of an ad
+	http.HandleFunc("/searchAdReviews", s.handleFuncSearchAdReviews)
+	// handler22-24: post: events on an ad served by an auction ({"auction_id", "ad_id"})
+	// the event of the ad's billing model (click, impression or conversion) charges the advertiser,
+	// a billed click also carries the click token served with the ad ({"token"})
+	http.HandleFunc("/events/impression", s.handleFuncImpression)
+	http.HandleFunc("/events/click", s.handleFuncClick)
+	http.HandleFunc("/events/conversion", s.handleFuncConversion)
+	// handler25: post: event counts of an ad_id
+	http.HandleFunc("/searchAdStats", s.handleFuncSearchAdStats)
+	// handler26: get: follow a signed click url (/click?token=...), record the click and redirect to the landing page
+	http.HandleFunc("/click", s.handleFuncClickRedirect)
+	// handler27: post: set the daily budget and pacing of an advertiser
+	http.HandleFunc("/setDailyBudget", s.handleFuncSetDailyBudget)
 
-	http.ListenAndServe("localhost:8080", nil)
+	httpServer := &http.Server{
+		Addr:         cfg.ListenAddress,
+		ReadTimeout:  cfg.ReadTimeout.Duration,
+		WriteTimeout: cfg.WriteTimeout.Duration,
+	}
+	log.Println(httpServer.ListenAndServe())
 }
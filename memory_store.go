@@ -0,0 +1,598 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps everything in process memory
+// used for tests and local development (-store memory); nothing survives a restart
+type memoryStore struct {
+	mu               sync.Mutex
+	ads              []Ad
+	advertisers      []Advertiser
+	transactions     []BudgetTransaction
+	campaigns        []Campaign
+	adGroups         []AdGroup
+	reviews          []AdReview
+	auctionWinners   map[string][]AuctionWinner
+	chargedWinners   map[string]bool
+	appliedFlushes   map[string]bool
+	events           []AdEvent
+	eventKeys        map[string]bool
+	nextAdID         int
+	nextAdvertiserID int
+	nextTransaction  int
+	nextCampaignID   int
+	nextAdGroupID    int
+	nextReviewID     int
+	nextEventID      int
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		auctionWinners:   map[string][]AuctionWinner{},
+		chargedWinners:   map[string]bool{},
+		appliedFlushes:   map[string]bool{},
+		eventKeys:        map[string]bool{},
+		nextAdID:         1,
+		nextAdvertiserID: 1,
+		nextTransaction:  1,
+		nextCampaignID:   1,
+		nextAdGroupID:    1,
+		nextReviewID:     1,
+		nextEventID:      1,
+	}
+}
+
+func (store *memoryStore) InsertAd(ad Ad) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	ad.AdID = store.nextAdID
+	store.nextAdID++
+	store.ads = append(store.ads, ad)
+	return nil
+}
+
+func (store *memoryStore) SelectAd(adID int) (Ad, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, ad := range store.ads {
+		if ad.AdID == adID {
+			return ad, nil
+		}
+	}
+	return Ad{}, errors.New("Ad not found")
+}
+
+func (store *memoryStore) SelectActiveAds() ([]Ad, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var ads []Ad
+	for _, ad := range store.ads {
+		if ad.Status == adStatusActive {
+			ads = append(ads, ad)
+		}
+	}
+	return ads, nil
+}
+
+func (store *memoryStore) SetAdStatus(adID int, from, to string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i := range store.ads {
+		if store.ads[i].AdID == adID {
+			if store.ads[i].Status != from {
+				return false, nil
+			}
+			store.ads[i].Status = to
+			return true, nil
+		}
+	}
+	return false, errors.New("Ad not found")
+}
+
+func (store *memoryStore) SelectAdsByStatus(status string) ([]Ad, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var ads []Ad
+	for _, ad := range store.ads {
+		if ad.Status == status {
+			ads = append(ads, ad)
+		}
+	}
+	return ads, nil
+}
+
+func (store *memoryStore) ReviewAd(review AdReview) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i := range store.ads {
+		if store.ads[i].AdID != review.AdID {
+			continue
+		}
+		if store.ads[i].Status != adStatusPendingReview {
+			return false, nil
+		}
+		store.ads[i].Status = reviewedAdStatus(review.Decision)
+		review.ReviewID = store.nextReviewID
+		review.CreatedAt = time.Now()
+		store.nextReviewID++
+		store.reviews = append(store.reviews, review)
+		return true, nil
+	}
+	return false, errors.New("Ad not found")
+}
+
+func (store *memoryStore) SelectAdReviews(adID int) ([]AdReview, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var reviews []AdReview
+	for _, review := range store.reviews {
+		if review.AdID == adID {
+			reviews = append(reviews, review)
+		}
+	}
+	return reviews, nil
+}
+
+func (store *memoryStore) SelectAdsByAdvertiserID(id int) ([]Ad, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var ads []Ad
+	for _, ad := range store.ads {
+		if ad.AdvertiserID == id {
+			ads = append(ads, ad)
+		}
+	}
+	return ads, nil
+}
+
+func (store *memoryStore) DeleteAd(adID int) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i, ad := range store.ads {
+		if ad.AdID == adID {
+			store.ads = append(store.ads[:i], store.ads[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (store *memoryStore) InsertAdvertiser(advertiser Advertiser) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, a := range store.advertisers {
+		if a.Name == advertiser.Name {
+			return errors.New("Advertiser already exists")
+		}
+	}
+	advertiser.AdvertiserID = store.nextAdvertiserID
+	store.nextAdvertiserID++
+	store.advertisers = append(store.advertisers, advertiser)
+	return nil
+}
+
+func (store *memoryStore) SearchAdvertiser(name string) (Advertiser, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, a := range store.advertisers {
+		if a.Name == name {
+			return a, nil
+		}
+	}
+	return Advertiser{}, errors.New("Failed to select from advertiser table")
+}
+
+func (store *memoryStore) SelectAdvertiserBudgets() (map[int]Money, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	budgets := map[int]Money{}
+	for _, a := range store.advertisers {
+		budgets[a.AdvertiserID] = a.Budget
+	}
+	return budgets, nil
+}
+
+func (store *memoryStore) ChangeBudget(advertiserID int, campaignID int, amount Money, txType string, adID int) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var campaign *Campaign
+	if campaignID != 0 {
+		for i := range store.campaigns {
+			if store.campaigns[i].CampaignID == campaignID {
+				campaign = &store.campaigns[i]
+			}
+		}
+		if campaign == nil {
+			return false, errors.New("Campaign not found")
+		}
+	}
+
+	for i := range store.advertisers {
+		a := &store.advertisers[i]
+		if a.AdvertiserID != advertiserID {
+			continue
+		}
+		// never drive the budgets below zero; campaign_budget leaves the advertiser balance alone
+		advertiserAmount := amount
+		if txType == transactionCampaignBudget {
+			advertiserAmount = 0
+		}
+		if a.Budget+advertiserAmount < 0 || (campaign != nil && campaign.Budget+amount < 0) {
+			return false, nil
+		}
+		a.Budget += advertiserAmount
+		if campaign != nil {
+			campaign.Budget += amount
+		}
+		store.transactions = append(store.transactions, BudgetTransaction{
+			TransactionID: store.nextTransaction,
+			AdvertiserID:  advertiserID,
+			Type:          txType,
+			Amount:        amount,
+			AdID:          adID,
+			CampaignID:    campaignID,
+			CreatedAt:     time.Now(),
+			BalanceAfter:  a.Budget,
+		})
+		store.nextTransaction++
+		return true, nil
+	}
+	return false, errors.New("Advertiser not found")
+}
+
+func (store *memoryStore) SelectBudgetTransactions(advertiserID int, from, to time.Time) ([]BudgetTransaction, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var transactions []BudgetTransaction
+	for _, t := range store.transactions {
+		if t.AdvertiserID != advertiserID {
+			continue
+		}
+		if (!from.IsZero() && t.CreatedAt.Before(from)) || (!to.IsZero() && !t.CreatedAt.Before(to)) {
+			continue
+		}
+		transactions = append(transactions, t)
+	}
+	return transactions, nil
+}
+
+func (store *memoryStore) ApplySpend(flushID string, charges []SpendCharge) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.appliedFlushes[flushID] {
+		return nil
+	}
+	store.appliedFlushes[flushID] = true
+
+	for _, c := range charges {
+		chargedAt := c.ChargedAt
+		for i := range store.advertisers {
+			a := &store.advertisers[i]
+			if a.AdvertiserID != c.AdvertiserID {
+				continue
+			}
+			debit := spendDebit(a.Budget, c)
+			a.Budget -= debit
+			for j := range store.campaigns {
+				if c.CampaignID != 0 && store.campaigns[j].CampaignID == c.CampaignID {
+					store.campaigns[j].Budget -= spendDebit(store.campaigns[j].Budget, c)
+				}
+			}
+			store.transactions = append(store.transactions, BudgetTransaction{
+				TransactionID: store.nextTransaction,
+				AdvertiserID:  c.AdvertiserID,
+				Type:          transactionAuctionCharge,
+				Amount:        -debit,
+				AdID:          c.AdID,
+				CampaignID:    c.CampaignID,
+				CreatedAt:     time.Now(),
+				BalanceAfter:  a.Budget,
+				ChargedAt:     &chargedAt,
+			})
+			store.nextTransaction++
+		}
+	}
+	return nil
+}
+
+func (store *memoryStore) SetDailyBudget(advertiserID int, amount Money, pacing string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i := range store.advertisers {
+		if store.advertisers[i].AdvertiserID == advertiserID {
+			store.advertisers[i].DailyBudget, store.advertisers[i].Pacing = amount, pacing
+			return nil
+		}
+	}
+	return errors.New("Advertiser not found")
+}
+
+func (store *memoryStore) SelectDailyBudgets() (map[int]dailyBudget, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	dailyBudgets := map[int]dailyBudget{}
+	for _, a := range store.advertisers {
+		if a.DailyBudget > 0 {
+			dailyBudgets[a.AdvertiserID] = dailyBudget{amount: a.DailyBudget, pacing: a.Pacing}
+		}
+	}
+	return dailyBudgets, nil
+}
+
+func (store *memoryStore) SelectSpendSince(since time.Time) (map[int]Money, map[int]Money, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	spent := map[int]Money{}
+	campaignSpent := map[int]Money{}
+	for _, t := range store.transactions {
+		if t.Type != transactionAuctionCharge || t.ChargedAt == nil || t.ChargedAt.Before(since) {
+			continue
+		}
+		spent[t.AdvertiserID] -= t.Amount
+		if t.CampaignID != 0 {
+			campaignSpent[t.CampaignID] -= t.Amount
+		}
+	}
+	return spent, campaignSpent, nil
+}
+
+func (store *memoryStore) InsertCampaign(campaign Campaign) (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	campaign.CampaignID = store.nextCampaignID
+	store.nextCampaignID++
+	store.campaigns = append(store.campaigns, campaign)
+	return campaign.CampaignID, nil
+}
+
+func (store *memoryStore) UpdateCampaign(campaign Campaign) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i, c := range store.campaigns {
+		if c.CampaignID == campaign.CampaignID {
+			// the owner never changes, the budget changes through ChangeBudget
+			campaign.AdvertiserID = c.AdvertiserID
+			campaign.Budget = c.Budget
+			store.campaigns[i] = campaign
+			return nil
+		}
+	}
+	return errors.New("Campaign not found")
+}
+
+func (store *memoryStore) DeleteCampaign(campaignID int) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, g := range store.adGroups {
+		if g.CampaignID == campaignID {
+			return errors.New("Failed to delete campaign")
+		}
+	}
+	for i, c := range store.campaigns {
+		if c.CampaignID == campaignID {
+			store.campaigns = append(store.campaigns[:i], store.campaigns[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (store *memoryStore) SelectCampaign(campaignID int) (Campaign, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, c := range store.campaigns {
+		if c.CampaignID == campaignID {
+			return c, nil
+		}
+	}
+	return Campaign{}, errors.New("Campaign not found")
+}
+
+func (store *memoryStore) SelectCampaigns(advertiserID int) ([]Campaign, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var campaigns []Campaign
+	for _, c := range store.campaigns {
+		if advertiserID == 0 || c.AdvertiserID == advertiserID {
+			campaigns = append(campaigns, c)
+		}
+	}
+	return campaigns, nil
+}
+
+func (store *memoryStore) InsertAdGroup(group AdGroup) (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	group.AdGroupID = store.nextAdGroupID
+	store.nextAdGroupID++
+	store.adGroups = append(store.adGroups, group)
+	return group.AdGroupID, nil
+}
+
+func (store *memoryStore) UpdateAdGroup(group AdGroup) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i, g := range store.adGroups {
+		if g.AdGroupID == group.AdGroupID {
+			// the campaign never changes
+			group.CampaignID = g.CampaignID
+			store.adGroups[i] = group
+			return nil
+		}
+	}
+	return errors.New("Ad group not found")
+}
+
+func (store *memoryStore) DeleteAdGroup(adGroupID int) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, ad := range store.ads {
+		if ad.AdGroupID == adGroupID {
+			return errors.New("Failed to delete ad group")
+		}
+	}
+	for i, g := range store.adGroups {
+		if g.AdGroupID == adGroupID {
+			store.adGroups = append(store.adGroups[:i], store.adGroups[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (store *memoryStore) SelectAdGroup(adGroupID int) (AdGroup, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, g := range store.adGroups {
+		if g.AdGroupID == adGroupID {
+			return g, nil
+		}
+	}
+	return AdGroup{}, errors.New("Ad group not found")
+}
+
+func (store *memoryStore) SelectAdGroups(campaignID int) ([]AdGroup, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var groups []AdGroup
+	for _, g := range store.adGroups {
+		if campaignID == 0 || g.CampaignID == campaignID {
+			groups = append(groups, g)
+		}
+	}
+	return groups, nil
+}
+
+func (store *memoryStore) InsertAuctions(auctions map[string][]AuctionWinner) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for auctionID, winners := range auctions {
+		if _, ok := store.auctionWinners[auctionID]; ok {
+			continue
+		}
+		recorded := make([]AuctionWinner, len(winners))
+		copy(recorded, winners)
+		store.auctionWinners[auctionID] = recorded
+	}
+	return nil
+}
+
+func (store *memoryStore) SelectAuction(auctionID string) ([]AuctionWinner, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	winners, ok := store.auctionWinners[auctionID]
+	if !ok {
+		return nil, errors.New("Auction not found")
+	}
+	return winners, nil
+}
+
+func (store *memoryStore) MarkCharged(auctionID string, adID int) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	key := auctionID + "/" + strconv.Itoa(adID)
+	if store.chargedWinners[key] {
+		return false, nil
+	}
+	store.chargedWinners[key] = true
+	return true, nil
+}
+
+func (store *memoryStore) ClearCharged(auctionID string, adID int) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.chargedWinners, auctionID+"/"+strconv.Itoa(adID))
+	return nil
+}
+
+func (store *memoryStore) InsertEvent(event AdEvent) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	key := event.AuctionID + "/" + strconv.Itoa(event.AdID) + "/" + event.Type
+	if store.eventKeys[key] {
+		return false, nil
+	}
+	store.eventKeys[key] = true
+	event.EventID = store.nextEventID
+	event.CreatedAt = time.Now()
+	store.nextEventID++
+	store.events = append(store.events, event)
+	return true, nil
+}
+
+func (store *memoryStore) SelectAdStats(adID int) (AdStats, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	stats := AdStats{AdID: adID}
+	for _, event := range store.events {
+		if event.AdID == adID {
+			stats.add(event.Type, 1)
+		}
+	}
+	return stats, nil
+}
+
+func (store *memoryStore) SelectAllAdStats() (map[int]AdStats, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	all := map[int]AdStats{}
+	for _, event := range store.events {
+		stats := all[event.AdID]
+		stats.AdID = event.AdID
+		stats.add(event.Type, 1)
+		all[event.AdID] = stats
+	}
+	return all, nil
+}
+
+func (store *memoryStore) UpdateAdScores(scores map[int]float64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i := range store.ads {
+		if score, ok := scores[store.ads[i].AdID]; ok {
+			store.ads[i].AdScore = score
+		}
+	}
+	return nil
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migration type: one numbered schema change and the statements that undo it
+type Migration struct {
+	Version int
+	Name    string
+	Up      []string
+	// run after Up, for changes that depend on what the database already looks like; must be safe to run again
+	UpFunc func(db *sql.DB) error
+	Down   []string
+}
+
+/*
+every schema change, oldest first
+never edit a migration that has been released: add a new one instead
+*/
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create advertiser, ad and budget_transaction tables",
+		// IF NOT EXISTS: databases created by the old drop-and-recreate script already have them
+		Up: []string{
+			"CREATE TABLE IF NOT EXISTS advertiser (advertiser_id INT NOT NULL AUTO_INCREMENT, name VARCHAR(255), budget BIGINT, PRIMARY KEY (advertiser_id))",
+			"CREATE TABLE IF NOT EXISTS ad (ad_id INT NOT NULL AUTO_INCREMENT, bid BIGINT, image_url VARCHAR(2083), advertiser_id INT NOT NULL, ad_score FLOAT, PRIMARY KEY(ad_id), FOREIGN KEY(advertiser_id) REFERENCES advertiser(advertiser_id))",
+			"CREATE TABLE IF NOT EXISTS budget_transaction (transaction_id INT NOT NULL AUTO_INCREMENT, advertiser_id INT NOT NULL, type VARCHAR(32) NOT NULL, amount BIGINT NOT NULL, ad_id INT, created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, balance_after BIGINT NOT NULL, PRIMARY KEY(transaction_id), INDEX(advertiser_id, created_at), FOREIGN KEY(advertiser_id) REFERENCES advertiser(advertiser_id))",
+		},
+		Down: []string{
+			"DROP TABLE budget_transaction",
+			"DROP TABLE ad",
+			"DROP TABLE advertiser",
+		},
+	},
+	{
+		Version: 2,
+		Name:    "add campaign and ad_group between advertiser and ad",
+		Up: []string{
+			"CREATE TABLE campaign (campaign_id INT NOT NULL AUTO_INCREMENT, advertiser_id INT NOT NULL, name VARCHAR(255) NOT NULL, budget BIGINT NOT NULL DEFAULT 0, start_time DATETIME NULL, end_time DATETIME NULL, placements VARCHAR(1024) NOT NULL DEFAULT '', paused BOOL NOT NULL DEFAULT FALSE, PRIMARY KEY(campaign_id), FOREIGN KEY(advertiser_id) REFERENCES advertiser(advertiser_id))",
+			"CREATE TABLE ad_group (ad_group_id INT NOT NULL AUTO_INCREMENT, campaign_id INT NOT NULL, name VARCHAR(255) NOT NULL, default_bid BIGINT NOT NULL DEFAULT 0, paused BOOL NOT NULL DEFAULT FALSE, PRIMARY KEY(ad_group_id), FOREIGN KEY(campaign_id) REFERENCES campaign(campaign_id))",
+			"ALTER TABLE ad ADD COLUMN ad_group_id INT NULL, ADD CONSTRAINT fk_ad_ad_group FOREIGN KEY(ad_group_id) REFERENCES ad_group(ad_group_id)",
+			"ALTER TABLE budget_transaction ADD COLUMN campaign_id INT NULL",
+		},
+		Down: []string{
+			"ALTER TABLE budget_transaction DROP COLUMN campaign_id",
+			"ALTER TABLE ad DROP FOREIGN KEY fk_ad_ad_group",
+			"ALTER TABLE ad DROP COLUMN ad_group_id",
+			"DROP TABLE ad_group",
+			"DROP TABLE campaign",
+		},
+	},
+	{
+		Version: 3,
+		Name:    "add ad status",
+		// ads that already exist keep serving
+		Up: []string{
+			"ALTER TABLE ad ADD COLUMN status VARCHAR(32) NOT NULL DEFAULT 'active', ADD INDEX idx_ad_status (status)",
+		},
+		Down: []string{
+			"ALTER TABLE ad DROP INDEX idx_ad_status, DROP COLUMN status",
+		},
+	},
+	{
+		Version: 4,
+		Name:    "create ad_review table",
+		Up: []string{
+			"CREATE TABLE ad_review (review_id INT NOT NULL AUTO_INCREMENT, ad_id INT NOT NULL, decision VARCHAR(16) NOT NULL, reason VARCHAR(1024) NOT NULL DEFAULT '', reviewer VARCHAR(255) NOT NULL, created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, PRIMARY KEY(review_id), INDEX(ad_id), FOREIGN KEY(ad_id) REFERENCES ad(ad_id) ON DELETE CASCADE)",
+		},
+		Down: []string{
+			"DROP TABLE ad_review",
+		},
+	},
+	{
+		Version: 5,
+		Name:    "create auction_winner and ad_event tables",
+		Up: []string{
+			"CREATE TABLE auction_winner (auction_id CHAR(32) NOT NULL, position INT NOT NULL, ad_id INT NOT NULL, advertiser_id INT NOT NULL, campaign_id INT NULL, price BIGINT NOT NULL, created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, PRIMARY KEY(auction_id, position), INDEX(ad_id))",
+			"CREATE TABLE ad_event (event_id BIGINT NOT NULL AUTO_INCREMENT, auction_id CHAR(32) NOT NULL, ad_id INT NOT NULL, type VARCHAR(16) NOT NULL, created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, PRIMARY KEY(event_id), INDEX(auction_id), INDEX(ad_id, type))",
+		},
+		Down: []string{
+			"DROP TABLE ad_event",
+			"DROP TABLE auction_winner",
+		},
+	},
+	{
+		Version: 6,
+		Name:    "add auction_winner.charged_at",
+		Up: []string{
+			"ALTER TABLE auction_winner ADD COLUMN charged_at TIMESTAMP NULL DEFAULT NULL",
+		},
+		Down: []string{
+			"ALTER TABLE auction_winner DROP COLUMN charged_at",
+		},
+	},
+	{
+		Version: 7,
+		Name:    "add billing_model to ad and auction_winner",
+		Up: []string{
+			"ALTER TABLE ad ADD COLUMN billing_model VARCHAR(8) NOT NULL DEFAULT 'cpc'",
+			"ALTER TABLE auction_winner ADD COLUMN billing_model VARCHAR(8) NOT NULL DEFAULT 'cpc'",
+		},
+		Down: []string{
+			"ALTER TABLE auction_winner DROP COLUMN billing_model",
+			"ALTER TABLE ad DROP COLUMN billing_model",
+		},
+	},
+	{
+		Version: 8,
+		Name:    "add ad.landing_url",
+		Up: []string{
+			"ALTER TABLE ad ADD COLUMN landing_url VARCHAR(2083) NOT NULL DEFAULT ''",
+		},
+		Down: []string{
+			"ALTER TABLE ad DROP COLUMN landing_url",
+		},
+	},
+	{
+		Version: 9,
+		Name:    "add frequency caps to ad and campaign",
+		// freq_cap_window in seconds, 0 impressions: no cap
+		Up: []string{
+			"ALTER TABLE ad ADD COLUMN freq_cap_impressions INT NOT NULL DEFAULT 0, ADD COLUMN freq_cap_window INT NOT NULL DEFAULT 0",
+			"ALTER TABLE campaign ADD COLUMN freq_cap_impressions INT NOT NULL DEFAULT 0, ADD COLUMN freq_cap_window INT NOT NULL DEFAULT 0",
+		},
+		Down: []string{
+			"ALTER TABLE campaign DROP COLUMN freq_cap_impressions, DROP COLUMN freq_cap_window",
+			"ALTER TABLE ad DROP COLUMN freq_cap_impressions, DROP COLUMN freq_cap_window",
+		},
+	},
+	{
+		Version: 10,
+		Name:    "add targeting rules to ad and campaign",
+		// JSON of the Targeting type, NULL: no rules
+		Up: []string{
+			"ALTER TABLE ad ADD COLUMN targeting TEXT NULL",
+			"ALTER TABLE campaign ADD COLUMN targeting TEXT NULL",
+		},
+		Down: []string{
+			"ALTER TABLE campaign DROP COLUMN targeting",
+			"ALTER TABLE ad DROP COLUMN targeting",
+		},
+	},
+	{
+		Version: 11,
+		Name:    "add spend_flush",
+		// one row per batch of auction charges written to the budgets, so a batch is never applied twice
+		Up: []string{
+			"CREATE TABLE spend_flush (flush_id VARCHAR(64) NOT NULL, applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, PRIMARY KEY(flush_id))",
+		},
+		Down: []string{
+			"DROP TABLE spend_flush",
+		},
+	},
+	{
+		Version: 12,
+		Name:    "add daily budgets and pacing to advertiser and campaign",
+		// daily_budget 0: no daily cap
+		Up: []string{
+			"ALTER TABLE advertiser ADD COLUMN daily_budget BIGINT NOT NULL DEFAULT 0, ADD COLUMN pacing VARCHAR(8) NOT NULL DEFAULT 'even'",
+			"ALTER TABLE campaign ADD COLUMN daily_budget BIGINT NOT NULL DEFAULT 0, ADD COLUMN pacing VARCHAR(8) NOT NULL DEFAULT 'even'",
+		},
+		Down: []string{
+			"ALTER TABLE campaign DROP COLUMN pacing, DROP COLUMN daily_budget",
+			"ALTER TABLE advertiser DROP COLUMN pacing, DROP COLUMN daily_budget",
+		},
+	},
+	{
+		Version: 13,
+		Name:    "one ad_event of each type per auction winner",
+		// repeated events would inflate the click-through rates the adscores are learned from
+		Up: []string{
+			"DELETE later FROM ad_event later JOIN ad_event first ON later.auction_id = first.auction_id AND later.ad_id = first.ad_id AND later.type = first.type AND later.event_id > first.event_id",
+			"ALTER TABLE ad_event ADD UNIQUE INDEX auction_ad_type (auction_id, ad_id, type)",
+		},
+		Down: []string{
+			"ALTER TABLE ad_event DROP INDEX auction_ad_type",
+		},
+	},
+	{
+		Version: 14,
+		Name:    "convert FLOAT money columns to BIGINT micro-units",
+		// databases from before money was stored as micro-units passed 0001 with their FLOAT columns
+		// nothing to do for the BIGINT columns 0001 creates, nothing to undo
+		UpFunc: convertMoneyToMicros,
+	},
+	{
+		Version: 15,
+		Name:    "add budget_transaction.charged_at",
+		// an auction charge is written by the flush after it was made: daily spend is counted on charged_at
+		Up: []string{
+			"ALTER TABLE budget_transaction ADD COLUMN charged_at TIMESTAMP NULL DEFAULT NULL, ADD INDEX type_charged_at (type, charged_at)",
+			"UPDATE budget_transaction SET charged_at = created_at WHERE type = 'auction_charge'",
+		},
+		Down: []string{
+			"ALTER TABLE budget_transaction DROP INDEX type_charged_at, DROP COLUMN charged_at",
+		},
+	},
+}
+
+// the money columns: table, column, definition after the conversion
+var moneyColumns = [][3]string{
+	{"advertiser", "budget", "BIGINT"},
+	{"ad", "bid", "BIGINT"},
+	{"budget_transaction", "amount", "BIGINT NOT NULL"},
+	{"budget_transaction", "balance_after", "BIGINT NOT NULL"},
+}
+
+/*
+convert every FLOAT / DOUBLE / DECIMAL money column to BIGINT micro-units (1.50 ==> 1500000)
+*/
+func convertMoneyToMicros(db *sql.DB) error {
+	for _, c := range moneyColumns {
+		if err := convertMoneyColumn(db, c[0], c[1], c[2]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+convert one money column through a "<column>_micros" helper column:
+	add the helper next to the column
+	fill it with the rounded micro-units
+	drop the column and rename the helper to it, in one ALTER TABLE
+MySQL commits every ALTER TABLE on its own, so each step can be interrupted:
+the column type and the helper tell which steps are left, and none of them scales a value twice
+*/
+func convertMoneyColumn(db *sql.DB, table, column, definition string) error {
+	dataType, err := columnType(db, table, column)
+	if err != nil {
+		return err
+	}
+	helper := column + "_micros"
+	helperType, err := columnType(db, table, helper)
+	if err != nil {
+		return err
+	}
+	if helperType == "" && dataType != "float" && dataType != "double" && dataType != "decimal" {
+		// already micro-units (or no such column)
+		return nil
+	}
+
+	fmt.Printf("converting %s.%s from %s to micro-units\n", table, column, dataType)
+	statements := []string{
+		"UPDATE " + table + " SET " + helper + " = ROUND(" + column + " * 1000000)",
+		"ALTER TABLE " + table + " DROP COLUMN " + column + ", CHANGE " + helper + " " + column + " " + definition,
+	}
+	if helperType == "" {
+		statements = append([]string{"ALTER TABLE " + table + " ADD COLUMN " + helper + " BIGINT NULL AFTER " + column}, statements...)
+	}
+	for _, statement := range statements {
+		if _, err = db.Exec(statement); err != nil {
+			return fmt.Errorf("Failed at %q: %v", statement, err)
+		}
+	}
+	return nil
+}
+
+/*
+the DATA_TYPE of a column in information_schema, "" when there is no such column
+*/
+func columnType(db *sql.DB, table, column string) (string, error) {
+	var dataType string
+	err := db.QueryRow("SELECT DATA_TYPE FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?", table, column).Scan(&dataType)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.New("Failed to select from information_schema")
+	}
+	return strings.ToLower(dataType), nil
+}
+
+/*
+create schema_version if needed and read the applied versions
+return:
+	version ==> time it was applied
+*/
+func appliedMigrations(db *sql.DB) (map[int]time.Time, error) {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INT NOT NULL, name VARCHAR(255) NOT NULL, applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, PRIMARY KEY(version))"); err != nil {
+		return nil, errors.New("Failed to create schema_version table")
+	}
+
+	result, err := db.Query("SELECT version, applied_at FROM schema_version")
+	if err != nil {
+		return nil, errors.New("Failed to select from schema_version table")
+	}
+	defer result.Close()
+
+	applied := map[int]time.Time{}
+	for result.Next() {
+		var version int
+		var appliedAt time.Time
+		if err = result.Scan(&version, &appliedAt); err != nil {
+			return nil, errors.New("Failed to convert MySQL data into schema version")
+		}
+		applied[version] = appliedAt
+	}
+	return applied, nil
+}
+
+/*
+run the statements of one migration step and record it in schema_version
+MySQL commits DDL statements right away, so a failing step may be half applied:
+the error names the statement to fix by hand
+*/
+func runMigrationStep(db *sql.DB, m Migration, up bool) error {
+	statements := m.Down
+	if up {
+		statements = m.Up
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			return fmt.Errorf("Migration %04d failed at %q: %v", m.Version, statement, err)
+		}
+	}
+	if up && m.UpFunc != nil {
+		if err := m.UpFunc(db); err != nil {
+			return fmt.Errorf("Migration %04d failed: %v", m.Version, err)
+		}
+	}
+
+	var err error
+	if up {
+		_, err = db.Exec("INSERT INTO schema_version (version, name) VALUES (?, ?)", m.Version, m.Name)
+	} else {
+		_, err = db.Exec("DELETE FROM schema_version WHERE version = ?", m.Version)
+	}
+	if err != nil {
+		return fmt.Errorf("Migration %04d ran but schema_version was not updated: %v", m.Version, err)
+	}
+	return nil
+}
+
+/*
+apply the pending migrations up to and including version "to" (0: all)
+*/
+func migrateUp(db *sql.DB, to int) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok || (to > 0 && m.Version > to) {
+			continue
+		}
+		fmt.Printf("applying %04d %s\n", m.Version, m.Name)
+		if err = runMigrationStep(db, m, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+revert the applied migrations newer than version "to"
+to < 0: revert only the latest one
+*/
+func migrateDown(db *sql.DB, to int) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok || m.Version <= to {
+			continue
+		}
+		fmt.Printf("reverting %04d %s\n", m.Version, m.Name)
+		if err = runMigrationStep(db, m, false); err != nil {
+			return err
+		}
+		if to < 0 {
+			return nil
+		}
+	}
+	return nil
+}
+
+/*
+print every migration and whether it is applied
+*/
+func migrateStatus(db *sql.DB) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		state := "pending"
+		if appliedAt, ok := applied[m.Version]; ok {
+			state = "applied " + appliedAt.Format(time.RFC3339)
+		}
+		fmt.Printf("%04d  %-28s  %s\n", m.Version, state, m.Name)
+	}
+	return nil
+}
+
+/*
+the "migrate" command:
+	migrate up [-to N]      apply pending migrations (up to N)
+	migrate down [-to N]    revert the latest migration (or every one after N)
+	migrate status          list migrations
+the config flags (-config, -dsn, ...) select the database
+*/
+func runMigrate(args []string) error {
+	if len(args) == 0 || (args[0] != "up" && args[0] != "down" && args[0] != "status") {
+		return errors.New("Usage: migrate up|down|status [-to N] [config flags]")
+	}
+	action := args[0]
+
+	// -to is taken out before the rest goes to the config flags
+	to := -1
+	rest := []string{}
+	for i := 1; i < len(args); i++ {
+		if args[i] == "-to" && i+1 < len(args) {
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 0 {
+				return errors.New("-to must be a migration version")
+			}
+			to = n
+			i++
+			continue
+		}
+		rest = append(rest, args[i])
+	}
+
+	cfg, err := loadConfig(rest)
+	if err != nil {
+		return err
+	}
+	if cfg.Store != "mysql" {
+		return errors.New("migrate only works with the mysql store")
+	}
+	db, err := sql.Open("mysql", cfg.DSN)
+	if err != nil {
+		return errors.New("Failed to connect the database")
+	}
+	defer db.Close()
+
+	switch action {
+	case "up":
+		if to < 0 {
+			to = 0
+		}
+		return migrateUp(db, to)
+	case "down":
+		return migrateDown(db, to)
+	default:
+		return migrateStatus(db)
+	}
+}
+
+func migrateMain(args []string) {
+	if err := runMigrate(args); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(2)
+		}
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Money is an exact amount in micro-units: Money(1500000) is 1.50
+// JSON and MySQL carry it as a decimal number / BIGINT of micro-units
+type Money int64
+
+// number of micro-units in one unit of currency
+const microsPerUnit = 1000000
+
+// smallest price step of the auctions: 0.01
+const minBidIncrement Money = 10000
+
+/*
+convert a float amount (in units) to Money, rounding to the nearest micro-unit
+only used on the results of auction arithmetic, never on stored balances
+*/
+func moneyFromFloat(f float64) Money {
+	return Money(math.Floor(f*microsPerUnit + 0.5))
+}
+
+/*
+parse a decimal amount such as "12", "-0.5" or "3.141592" exactly
+return:
+	more than 6 decimal places or not a decimal number: err
+*/
+func parseMoney(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+
+	whole, fraction := s, ""
+	if i := strings.Index(s, "."); i >= 0 {
+		whole, fraction = s[:i], s[i+1:]
+	}
+	if whole == "" || len(fraction) > 6 {
+		return 0, errors.New("Money must be a decimal number with at most 6 decimal places")
+	}
+	for _, part := range []string{whole, fraction} {
+		for _, c := range part {
+			if c < '0' || c > '9' {
+				return 0, errors.New("Money must be a decimal number with at most 6 decimal places")
+			}
+		}
+	}
+
+	units, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || units > math.MaxInt64/microsPerUnit {
+		return 0, errors.New("Money is out of range")
+	}
+	var micros int64
+	if fraction != "" {
+		micros, _ = strconv.ParseInt(fraction+strings.Repeat("0", 6-len(fraction)), 10, 64)
+	}
+	// the whole amount must fit as well: 9223372036854.999999 would wrap around
+	if units*microsPerUnit > math.MaxInt64-micros {
+		return 0, errors.New("Money is out of range")
+	}
+
+	m := Money(units*microsPerUnit + micros)
+	if negative {
+		m = -m
+	}
+	return m, nil
+}
+
+// String formats the amount with 6 decimal places, e.g. "1.500000"
+func (m Money) String() string {
+	sign := ""
+	abs := int64(m)
+	if abs < 0 {
+		sign, abs = "-", -abs
+	}
+	micros := strconv.FormatInt(abs%microsPerUnit, 10)
+	return sign + strconv.FormatInt(abs/microsPerUnit, 10) + "." + strings.Repeat("0", 6-len(micros)) + micros
+}
+
+// Float64 is the amount in units, for ranking and reporting only
+func (m Money) Float64() float64 {
+	return float64(m) / microsPerUnit
+}
+
+// MarshalJSON writes the amount as a JSON decimal number
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// Set parses a command line flag value
+func (m *Money) Set(s string) error {
+	parsed, err := parseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// UnmarshalJSON reads a JSON decimal number (or a quoted one) exactly
+func (m *Money) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "null" {
+		return nil
+	}
+	parsed, err := parseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+func maxMoney(a, b Money) Money {
+	if a > b {
+		return a
+	}
+	return b
+}
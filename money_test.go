@@ -0,0 +1,45 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Money
+		wantErr bool
+	}{
+		{"12", 12000000, false},
+		{"-0.5", -500000, false},
+		{"3.141592", 3141592, false},
+		{" 1.5 ", 1500000, false},
+		{"0.000001", 1, false},
+		{"9223372036854.775807", math.MaxInt64, false},
+		{"-9223372036854.775807", -math.MaxInt64, false},
+		{"0.0000001", 0, true},
+		{"", 0, true},
+		{".5", 0, true},
+		{"1.2.3", 0, true},
+		{"1e6", 0, true},
+		{"abc", 0, true},
+		// the micro-units of these do not fit in an int64
+		{"9223372036854.775808", 0, true},
+		{"9223372036854.999999", 0, true},
+		{"9223372036855", 0, true},
+		{"99999999999999999999", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseMoney(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseMoney(%q) = %d, want an error", tt.in, int64(got))
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseMoney(%q) = %d, %v, want %d", tt.in, int64(got), err, int64(tt.want))
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// how a daily budget is spread over the day
+const (
+	// spend follows the elapsed fraction of the day
+	pacingEven = "even"
+	// spend as fast as the auctions allow until the daily budget is gone
+	pacingASAP = "asap"
+)
+
+// the daily budget of an advertiser; 0: no daily cap
+type dailyBudget struct {
+	amount Money
+	pacing string
+}
+
+/*
+check a daily budget and its pacing, an empty pacing becomes even
+*/
+func checkDailyBudget(amount Money, pacing *string) error {
+	if amount < 0 {
+		return errors.New("Daily budget must not be negative")
+	}
+	if *pacing == "" {
+		*pacing = pacingEven
+	}
+	if *pacing != pacingEven && *pacing != pacingASAP {
+		return errors.New("Pacing must be even or asap")
+	}
+	return nil
+}
+
+/*
+the midnight starting the day of "t", in the server's time zone
+*/
+func startOfDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
+
+/*
+fraction of the day of "now" already gone, in [0, 1)
+*/
+func elapsedFraction(now time.Time) float64 {
+	start := startOfDay(now)
+	end := start.AddDate(0, 0, 1)
+	return now.Sub(start).Seconds() / end.Sub(start).Seconds()
+}
+
+/*
+chance that an advertiser or campaign takes part in an auction
+	no daily budget: 1
+	daily budget spent: 0
+	asap: 1
+	even: 1 while the spend is behind daily * elapsed, else the ratio of the two,
+	so a spend running ahead of the day slows down until the day catches up
+*/
+func participation(daily, spent Money, pacing string, elapsed float64) float64 {
+	if daily <= 0 {
+		return 1
+	}
+	if spent >= daily {
+		return 0
+	}
+	if pacing == pacingASAP || spent <= 0 {
+		return 1
+	}
+	target := daily.Float64() * elapsed
+	if target >= spent.Float64() {
+		return 1
+	}
+	return target / spent.Float64()
+}
+
+/*
+start a new day of spend when "now" is past the current one; called with mu held for writing
+*/
+func (c *catalog) rollDay(now time.Time) {
+	if day := startOfDay(now); day.After(c.day) {
+		c.day = day
+		c.spentToday = map[int]Money{}
+		c.campaignSpentToday = map[int]Money{}
+	}
+}
+
+/*
+read the daily budgets and today's spend: the charges in the ledger made since midnight
+plus the pending charges made since midnight the spend writer had not flushed before the ledger was read
+*/
+func (c *catalog) loadDailySpend(now time.Time, advertiserSpend, campaignSpend map[int]Money) (map[int]dailyBudget, map[int]Money, map[int]Money, error) {
+	dailyBudgets, err := c.advertiserStore.SelectDailyBudgets()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	spent, campaignSpent, err := c.advertiserStore.SelectSpendSince(startOfDay(now))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for id, amount := range advertiserSpend {
+		spent[id] += amount
+	}
+	for id, amount := range campaignSpend {
+		campaignSpent[id] += amount
+	}
+	return dailyBudgets, spent, campaignSpent, nil
+}
+
+/*
+reload the daily budgets of the advertisers after one of them changed
+*/
+func (c *catalog) reloadDailyBudgets() error {
+	dailyBudgets, err := c.advertiserStore.SelectDailyBudgets()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dailyBudgets = dailyBudgets
+	return nil
+}
+
+// what the daily budgets allow in one auction
+type pacingState struct {
+	// daily budget left: advertiser_id / campaign_id ==> amount, only those of the auction with a daily budget
+	remaining         map[int]Money
+	campaignRemaining map[int]Money
+	// chance of taking part in the auction, only those below 1
+	participation         map[int]float64
+	campaignParticipation map[int]float64
+}
+
+/*
+the daily budgets left and the participation chances at time "now"
+of the advertisers and campaigns of "ads"
+read only: the spend of a day that has not been rolled yet (see rollDay) counts as nothing
+*/
+func (c *catalog) pacing(ads []Ad, now time.Time) pacingState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	spentToday, campaignSpentToday := c.spentToday, c.campaignSpentToday
+	if startOfDay(now).After(c.day) {
+		spentToday, campaignSpentToday = nil, nil
+	}
+	elapsed := elapsedFraction(now)
+	state := pacingState{
+		remaining:             map[int]Money{},
+		campaignRemaining:     map[int]Money{},
+		participation:         map[int]float64{},
+		campaignParticipation: map[int]float64{},
+	}
+	for _, ad := range ads {
+		if daily := c.dailyBudgets[ad.AdvertiserID]; daily.amount > 0 {
+			id := ad.AdvertiserID
+			state.remaining[id] = daily.amount - spentToday[id]
+			if p := participation(daily.amount, spentToday[id], daily.pacing, elapsed); p < 1 {
+				state.participation[id] = p
+			}
+		}
+		if campaign := c.campaigns[ad.CampaignID]; ad.CampaignID != 0 && campaign.DailyBudget > 0 {
+			id := ad.CampaignID
+			state.campaignRemaining[id] = campaign.DailyBudget - campaignSpentToday[id]
+			if p := participation(campaign.DailyBudget, campaignSpentToday[id], campaign.Pacing, elapsed); p < 1 {
+				state.campaignParticipation[id] = p
+			}
+		}
+	}
+	return state
+}
+
+/*
+lower the budgets of an auction to what is left of the daily budgets
+*/
+func (state pacingState) capBudgets(budgets, campaignBudgets map[int]Money) {
+	for id, left := range state.remaining {
+		if left < budgets[id] {
+			budgets[id] = left
+		}
+	}
+	for id, left := range state.campaignRemaining {
+		if left < campaignBudgets[id] {
+			campaignBudgets[id] = left
+		}
+	}
+}
+
+/*
+drop the ads of the advertisers and campaigns that sit this auction out
+one draw per advertiser / campaign: all its ads take part or none does
+*/
+func (state pacingState) throttle(ads []Ad) []Ad {
+	if len(state.participation) == 0 && len(state.campaignParticipation) == 0 {
+		return ads
+	}
+	taking := map[int]bool{}
+	campaignTaking := map[int]bool{}
+	var kept []Ad
+	for _, ad := range ads {
+		if p, ok := state.participation[ad.AdvertiserID]; ok {
+			if _, drawn := taking[ad.AdvertiserID]; !drawn {
+				taking[ad.AdvertiserID] = rand.Float64() < p
+			}
+			if !taking[ad.AdvertiserID] {
+				continue
+			}
+		}
+		if p, ok := state.campaignParticipation[ad.CampaignID]; ok && ad.CampaignID != 0 {
+			if _, drawn := campaignTaking[ad.CampaignID]; !drawn {
+				campaignTaking[ad.CampaignID] = rand.Float64() < p
+			}
+			if !campaignTaking[ad.CampaignID] {
+				continue
+			}
+		}
+		kept = append(kept, ad)
+	}
+	return kept
+}
+
+/*
+advertisers with a daily budget
+return:
+	advertiser_id ==> daily budget
+*/
+func (store *mysqlStore) SelectDailyBudgets() (map[int]dailyBudget, error) {
+	result, err := store.db.Query("SELECT advertiser_id, daily_budget, pacing FROM advertiser WHERE daily_budget > 0")
+	if err != nil {
+		return nil, errors.New("Failed to select from advertiser table")
+	}
+	defer result.Close()
+
+	dailyBudgets := map[int]dailyBudget{}
+	for result.Next() {
+		var id int
+		var amount int64
+		var pacing string
+		if err = result.Scan(&id, &amount, &pacing); err != nil {
+			return nil, errors.New("Failed to get advertiser budget")
+		}
+		dailyBudgets[id] = dailyBudget{amount: Money(amount), pacing: pacing}
+	}
+	return dailyBudgets, nil
+}
+
+/*
+sum the auction charges in the ledger made since "since" (charged_at, not when they were flushed)
+return:
+	advertiser_id ==> spend, campaign_id ==> spend
+*/
+func (store *mysqlStore) SelectSpendSince(since time.Time) (map[int]Money, map[int]Money, error) {
+	result, err := store.db.Query("SELECT advertiser_id, campaign_id, SUM(amount) FROM budget_transaction WHERE type = ? AND charged_at >= ? GROUP BY advertiser_id, campaign_id",
+		transactionAuctionCharge, since)
+	if err != nil {
+		return nil, nil, errors.New("Failed to select from budget_transaction table")
+	}
+	defer result.Close()
+
+	spent := map[int]Money{}
+	campaignSpent := map[int]Money{}
+	for result.Next() {
+		var advertiserID int
+		var nilCampaignID sql.NullInt64
+		var amount int64
+		if err = result.Scan(&advertiserID, &nilCampaignID, &amount); err != nil {
+			return nil, nil, errors.New("Failed to convert MySQL data into BudgetTransaction type")
+		}
+		// charges are negative amounts
+		spent[advertiserID] -= Money(amount)
+		if nilCampaignID.Valid {
+			campaignSpent[int(nilCampaignID.Int64)] -= Money(amount)
+		}
+	}
+	return spent, campaignSpent, nil
+}
+
+/*
+set the daily budget and pacing of an advertiser
+*/
+func (store *mysqlStore) SetDailyBudget(advertiserID int, amount Money, pacing string) error {
+	result, err := store.db.Exec("UPDATE advertiser SET daily_budget = ?, pacing = ? WHERE advertiser_id = ?", amount, pacing, advertiserID)
+	if err != nil {
+		return errors.New("Failed to update advertiser")
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		// MySQL counts changed rows: make sure the advertiser exists
+		var id int
+		if err = store.db.QueryRow("SELECT advertiser_id FROM advertiser WHERE advertiser_id = ?", advertiserID).Scan(&id); err == sql.ErrNoRows {
+			return errors.New("Advertiser not found")
+		}
+	}
+	return nil
+}
+
+/*
+HanldeFunction
+POST {"advertiser_id": 1, "daily_budget": 100, "pacing": "even"}
+set the daily budget (0: none) and pacing (even or asap, default even) of an advertiser
+*/
+func (s *server) handleFuncSetDailyBudget(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received one daily budget request")
+	w.Header().Set("Content-Type", "text/plain")
+
+	if req.Method != "POST" {
+		return
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	var advertiser Advertiser
+	if err := decoder.Decode(&advertiser); err != nil {
+		http.Error(w, "Cannot decode advertiser's data from client", 400)
+		log.Println("Cannot decode advertiser's data from client.", err)
+		return
+	}
+	if err := checkDailyBudget(advertiser.DailyBudget, &advertiser.Pacing); err != nil {
+		http.Error(w, err.Error()+".", 400)
+		return
+	}
+
+	if err := s.advertisers.SetDailyBudget(advertiser.AdvertiserID, advertiser.DailyBudget, advertiser.Pacing); err != nil {
+		if err.Error() == "Advertiser not found" {
+			http.Error(w, "Advertiser not found.", 404)
+		} else {
+			http.Error(w, err.Error()+".", 500)
+		}
+		return
+	}
+	w.Write([]byte("Daily budget updated successfully"))
+}
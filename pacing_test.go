@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestParticipation(t *testing.T) {
+	tests := []struct {
+		name    string
+		daily   Money
+		spent   Money
+		pacing  string
+		elapsed float64
+		want    float64
+	}{
+		{"no daily budget", 0, 50 * microsPerUnit, pacingEven, 0.5, 1},
+		{"daily budget spent", 100 * microsPerUnit, 100 * microsPerUnit, pacingEven, 0.9, 0},
+		{"daily budget overspent", 100 * microsPerUnit, 120 * microsPerUnit, pacingASAP, 0.9, 0},
+		{"asap", 100 * microsPerUnit, 90 * microsPerUnit, pacingASAP, 0.1, 1},
+		{"nothing spent yet", 100 * microsPerUnit, 0, pacingEven, 0, 1},
+		{"even, behind the day", 100 * microsPerUnit, 20 * microsPerUnit, pacingEven, 0.5, 1},
+		{"even, on the day", 100 * microsPerUnit, 50 * microsPerUnit, pacingEven, 0.5, 1},
+		{"even, ahead of the day", 100 * microsPerUnit, 60 * microsPerUnit, pacingEven, 0.3, 0.5},
+	}
+	for _, tt := range tests {
+		got := participation(tt.daily, tt.spent, tt.pacing, tt.elapsed)
+		if got < tt.want-1e-9 || got > tt.want+1e-9 {
+			t.Errorf("%s: participation = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
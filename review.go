@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// decisions of a creative review
+const (
+	reviewApproved = "approved"
+	reviewRejected = "rejected"
+)
+
+/*
+select the ads in one status, oldest first
+*/
+func (store *mysqlStore) SelectAdsByStatus(status string) ([]Ad, error) {
+	result, err := store.db.Query("SELECT "+adColumns+" FROM ad WHERE status = ? ORDER BY ad_id", status)
+	if err != nil {
+		return nil, errors.New("Failed to select ads by status from MySQL database")
+	}
+	defer result.Close()
+
+	return scanAds(result)
+}
+
+/*
+record a review decision and move the ad out of pending_review in one transaction
+approved ==> active, rejected ==> rejected
+return:
+	recorded: true, nil
+	ad is no longer pending review: false, nil
+*/
+func (store *mysqlStore) ReviewAd(review AdReview) (bool, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return false, errors.New("Failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE ad SET status = ? WHERE ad_id = ? AND status = ?", reviewedAdStatus(review.Decision), review.AdID, adStatusPendingReview)
+	if err != nil {
+		return false, errors.New("Failed to update ad status")
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return false, nil
+	}
+
+	if _, err = tx.Exec("INSERT INTO ad_review (ad_id, decision, reason, reviewer) VALUES (?, ?, ?, ?)", review.AdID, review.Decision, review.Reason, review.Reviewer); err != nil {
+		return false, errors.New("Failed to insert into ad_review table")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, errors.New("Failed to commit transaction")
+	}
+	return true, nil
+}
+
+/*
+select the review history of an ad, oldest first
+*/
+func (store *mysqlStore) SelectAdReviews(adID int) ([]AdReview, error) {
+	result, err := store.db.Query("SELECT review_id, ad_id, decision, reason, reviewer, created_at FROM ad_review WHERE ad_id = ? ORDER BY review_id", adID)
+	if err != nil {
+		return nil, errors.New("Failed to select from ad_review table")
+	}
+	defer result.Close()
+
+	var reviews []AdReview
+	for result.Next() {
+		var review AdReview
+		if err = result.Scan(&review.ReviewID, &review.AdID, &review.Decision, &review.Reason, &review.Reviewer, &review.CreatedAt); err != nil {
+			return nil, errors.New("Failed to convert MySQL data into AdReview type")
+		}
+		reviews = append(reviews, review)
+	}
+	return reviews, nil
+}
+
+// status an ad moves to after the review decision
+func reviewedAdStatus(decision string) string {
+	if decision == reviewApproved {
+		return adStatusActive
+	}
+	return adStatusRejected
+}
+
+/*
+HanldeFunction
+GET /pendingAds
+response the client with the moderation queue: the ads waiting for review, oldest first
+*/
+func (s *server) handleFuncPendingAds(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received one pending ads request")
+	w.Header().Set("Content-Type", "text/plain")
+
+	if req.Method != "GET" {
+		return
+	}
+
+	ads, err := s.ads.SelectAdsByStatus(adStatusPendingReview)
+	if err != nil {
+		http.Error(w, err.Error()+".", 500)
+		return
+	}
+	if ads == nil {
+		ads = []Ad{}
+	}
+	writeJSON(w, ads)
+}
+
+/*
+HanldeFunction
+POST {"ad_id": 1, "decision": "rejected", "reason": "misleading claim", "reviewer": "alice"}
+approve (ad becomes active) or reject (ad becomes rejected) a pending ad
+the reviewer is required, and so is the reason of a rejection
+*/
+func (s *server) handleFuncReviewAd(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received one ad review request")
+	w.Header().Set("Content-Type", "text/plain")
+
+	if req.Method != "POST" {
+		return
+	}
+
+	// decode the json format info into AdReview type
+	decoder := json.NewDecoder(req.Body)
+	var review AdReview
+	if err := decoder.Decode(&review); err != nil {
+		http.Error(w, "Cannot decode review's data from client", 400)
+		log.Println("Cannot decode review's data from client.", err)
+		return
+	}
+	review.Reviewer = strings.TrimSpace(review.Reviewer)
+	review.Reason = strings.TrimSpace(review.Reason)
+	if review.Decision != reviewApproved && review.Decision != reviewRejected {
+		http.Error(w, "Decision must be approved or rejected.", 400)
+		return
+	}
+	if review.Reviewer == "" {
+		http.Error(w, "Reviewer is required.", 400)
+		return
+	}
+	if review.Decision == reviewRejected && review.Reason == "" {
+		http.Error(w, "A rejection needs a reason.", 400)
+		return
+	}
+
+	if _, err := s.ads.SelectAd(review.AdID); err != nil {
+		if err.Error() == "Ad not found" {
+			http.Error(w, "Ad not found.", 404)
+		} else {
+			http.Error(w, err.Error()+".", 500)
+		}
+		return
+	}
+
+	recorded, err := s.ads.ReviewAd(review)
+	if err != nil {
+		http.Error(w, err.Error()+".", 500)
+		return
+	}
+	if !recorded {
+		http.Error(w, "Ad is not pending review.", 409)
+		return
+	}
+	log.Printf("Ad %d %s by %s\n", review.AdID, review.Decision, review.Reviewer)
+	w.Write([]byte("Ad " + review.Decision))
+}
+
+/*
+HanldeFunction
+POST {"ad_id": 1}
+response the client with the review decisions of the ad, oldest first
+*/
+func (s *server) handleFuncSearchAdReviews(w http.ResponseWriter, req *http.Request) {
+	log.Println("Received one ad reviews request")
+	w.Header().Set("Content-Type", "text/plain")
+
+	if req.Method != "POST" {
+		return
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	var ad Ad
+	if err := decoder.Decode(&ad); err != nil {
+		http.Error(w, "Cannot decode ad's data from client", 400)
+		log.Println("Cannot decode ad's data from client.", err)
+		return
+	}
+
+	reviews, err := s.ads.SelectAdReviews(ad.AdID)
+	if err != nil {
+		http.Error(w, err.Error()+".", 500)
+		return
+	}
+	if reviews == nil {
+		reviews = []AdReview{}
+	}
+	writeJSON(w, reviews)
+}
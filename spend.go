@@ -0,0 +1,623 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpendCharge type: an amount charged to an advertiser (and campaign) for an ad
+// one line of the spend journal
+type SpendCharge struct {
+	AdvertiserID int   `json:"advertiser_id"`
+	CampaignID   int   `json:"campaign_id,omitempty"`
+	AdID         int   `json:"ad_id"`
+	Amount       Money `json:"amount"`
+	// when the charge was made: the day whose daily budget it counts against
+	ChargedAt time.Time `json:"charged_at"`
+}
+
+// journaledAuction type: the winners of an auction
+// one line of the spend journal, told from a charge by its auction_id
+type journaledAuction struct {
+	AuctionID string          `json:"auction_id"`
+	Winners   []AuctionWinner `json:"winners"`
+}
+
+/*
+write-behind of the auction charges and winners
+a charge is taken from the in-memory catalog budgets and appended (fsync'ed) to the journal file,
+the winners of an auction are appended too, without an fsync of their own (the next charge syncs them),
+the journal is flushed to the store in batches every flush interval:
+	the journal is renamed to "<journal>.<flush id>.batch" and a new one started
+	the auctions not in the store yet are inserted, a winner already there is left as it is
+	the batch is applied in one store transaction recording the flush id, so it is never applied twice
+	the batch file is removed
+batch files left by a crash are applied at startup,
+a batch the store fails to apply (lost connection, lock wait timeout, ...) is retried with backoff,
+a batch that cannot be decoded is set aside for an operator, see quarantine
+an event on an auction not in the store yet stores the pending auctions first: see flushAuction
+*/
+type spendWriter struct {
+	store   AdvertiserStore
+	events  EventStore
+	catalog *catalog
+	path    string
+
+	// serializes the flushes
+	flushMu sync.Mutex
+	// batches that failed to apply: batch file ==> when to retry; held with flushMu
+	retries map[string]batchRetry
+	// serializes the inserts of the pending auctions
+	auctionFlushMu sync.Mutex
+
+	// held by the charges and the catalog reloads
+	mu sync.Mutex
+	// charges not applied to the store yet: advertiser_id / campaign_id ==> amount
+	unflushed          map[int]Money
+	unflushedCampaigns map[int]Money
+	// the same charges by the day they were made: start of day ==> totals
+	unflushedDays map[time.Time]*spendTotals
+
+	// held while writing the journal, never for a store call: auctions only wait for the charges' fsync
+	journalMu sync.Mutex
+	journal   *os.File
+	journaled int
+	// auctions not inserted in the store yet: auction_id ==> winners
+	auctions map[string][]AuctionWinner
+}
+
+/*
+open the journal at "path"
+a journal left by the previous process becomes a batch, to be applied by the first flush
+*/
+func newSpendWriter(path string, store AdvertiserStore, events EventStore) (*spendWriter, error) {
+	w := &spendWriter{store: store, events: events, path: path, unflushed: map[int]Money{}, unflushedCampaigns: map[int]Money{},
+		unflushedDays: map[time.Time]*spendTotals{}, auctions: map[string][]AuctionWinner{}, retries: map[string]batchRetry{}}
+
+	if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+		if err = w.rotate(); err != nil {
+			return nil, err
+		}
+	}
+
+	batches, err := w.batchFiles()
+	if err != nil {
+		return nil, err
+	}
+	// quarantined batches stay pending until an operator resolves them
+	quarantined, err := filepath.Glob(w.path + ".*.batch.failed")
+	if err != nil {
+		return nil, errors.New("Failed to list spend batches")
+	}
+	for _, batch := range append(batches, quarantined...) {
+		// a damaged batch is quarantined by the first flush, what can be read of it is pending
+		charges, auctions, err := readSpendBatch(batch)
+		if err != nil && err.Error() != "Damaged spend batch" {
+			return nil, err
+		}
+		w.addUnflushed(charges, 1)
+		for id, winners := range auctions {
+			w.auctions[id] = winners
+		}
+	}
+
+	journal, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.New("Failed to open spend journal " + path)
+	}
+	w.journal = journal
+	return w, nil
+}
+
+// "<journal>.<flush id>.batch"
+func (w *spendWriter) batchFiles() ([]string, error) {
+	batches, err := filepath.Glob(w.path + ".*.batch")
+	if err != nil {
+		return nil, errors.New("Failed to list spend batches")
+	}
+	sort.Strings(batches)
+	return batches, nil
+}
+
+/*
+rename the journal to a new batch file
+called with journalMu held, or before the journal is opened
+*/
+func (w *spendWriter) rotate() error {
+	flushID, err := newAuctionID()
+	if err != nil {
+		return err
+	}
+	// batches sort by time, then by random id
+	batch := w.path + "." + time.Now().UTC().Format("20060102T150405.000000000") + "-" + flushID + ".batch"
+	if err = os.Rename(w.path, batch); err != nil {
+		return errors.New("Failed to rotate spend journal")
+	}
+	return nil
+}
+
+// the unflushed charges of one day
+type spendTotals struct {
+	charges    int
+	advertiser map[int]Money
+	campaign   map[int]Money
+}
+
+// sign: 1 adds the charges to the unflushed totals, -1 takes them off; called with mu held
+func (w *spendWriter) addUnflushed(charges []SpendCharge, sign Money) {
+	for _, c := range charges {
+		w.unflushed[c.AdvertiserID] += sign * c.Amount
+		if c.CampaignID != 0 {
+			w.unflushedCampaigns[c.CampaignID] += sign * c.Amount
+		}
+
+		day := startOfDay(c.ChargedAt)
+		totals, ok := w.unflushedDays[day]
+		if !ok {
+			totals = &spendTotals{advertiser: map[int]Money{}, campaign: map[int]Money{}}
+			w.unflushedDays[day] = totals
+		}
+		totals.charges += int(sign)
+		totals.advertiser[c.AdvertiserID] += sign * c.Amount
+		if c.CampaignID != 0 {
+			totals.campaign[c.CampaignID] += sign * c.Amount
+		}
+		if totals.charges == 0 {
+			delete(w.unflushedDays, day)
+		}
+	}
+}
+
+/*
+the charges not applied to the store yet, per advertiser and per campaign; called with mu held
+*/
+func (w *spendWriter) pending() (map[int]Money, map[int]Money) {
+	advertisers := make(map[int]Money, len(w.unflushed))
+	for id, amount := range w.unflushed {
+		advertisers[id] = amount
+	}
+	campaigns := make(map[int]Money, len(w.unflushedCampaigns))
+	for id, amount := range w.unflushedCampaigns {
+		campaigns[id] = amount
+	}
+	return advertisers, campaigns
+}
+
+/*
+the charges not applied to the store yet made since "day", per advertiser and per campaign; called with mu held
+*/
+func (w *spendWriter) pendingSince(day time.Time) (map[int]Money, map[int]Money) {
+	advertisers := map[int]Money{}
+	campaigns := map[int]Money{}
+	for start, totals := range w.unflushedDays {
+		if start.Before(day) {
+			continue
+		}
+		for id, amount := range totals.advertiser {
+			advertisers[id] += amount
+		}
+		for id, amount := range totals.campaign {
+			campaigns[id] += amount
+		}
+	}
+	return advertisers, campaigns
+}
+
+/*
+charge "cost" to the advertiser and campaign
+return:
+	charged: true, nil
+	budget in the catalog too small: false, nil
+	journal not written (nothing charged): false, err
+*/
+func (w *spendWriter) charge(advertiserID, campaignID, adID int, cost Money) (bool, error) {
+	// a catalog reload holds mu: a charge is either in the budgets it replaces and in pending(), or in neither
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	if !w.catalog.reserveSpend(advertiserID, campaignID, cost, now) {
+		return false, nil
+	}
+
+	charge := SpendCharge{AdvertiserID: advertiserID, CampaignID: campaignID, AdID: adID, Amount: cost, ChargedAt: now}
+	line, _ := json.Marshal(charge)
+	w.journalMu.Lock()
+	err := w.appendJournal(line, true)
+	w.journalMu.Unlock()
+	if err != nil {
+		w.catalog.releaseSpend(advertiserID, campaignID, cost)
+		return false, err
+	}
+	w.addUnflushed([]SpendCharge{charge}, 1)
+	return true, nil
+}
+
+/*
+append one line to the journal, fsync'ed when "sync"; called with journalMu held
+*/
+func (w *spendWriter) appendJournal(line []byte, sync bool) error {
+	if _, err := w.journal.Write(append(line, '\n')); err != nil {
+		return errors.New("Failed to write spend journal")
+	}
+	if sync {
+		if err := w.journal.Sync(); err != nil {
+			return errors.New("Failed to write spend journal")
+		}
+	}
+	w.journaled++
+	return nil
+}
+
+/*
+journal the winners of an auction, to be inserted in the store by a later flush
+only what the auction_winner table keeps of a winner is journaled
+*/
+func (w *spendWriter) recordAuction(auctionID string, served []AuctionWinner) error {
+	winners := make([]AuctionWinner, len(served))
+	for i, winner := range served {
+		winners[i] = AuctionWinner{AuctionID: auctionID, Position: winner.Position, Price: winner.Price,
+			Ad: Ad{AdID: winner.Ad.AdID, AdvertiserID: winner.Ad.AdvertiserID, CampaignID: winner.Ad.CampaignID, BillingModel: winner.Ad.BillingModel}}
+	}
+	line, _ := json.Marshal(journaledAuction{AuctionID: auctionID, Winners: winners})
+
+	w.journalMu.Lock()
+	defer w.journalMu.Unlock()
+	if err := w.appendJournal(line, false); err != nil {
+		return err
+	}
+	w.auctions[auctionID] = winners
+	return nil
+}
+
+/*
+insert the auctions journaled but not in the store yet
+*/
+func (w *spendWriter) flushAuctions() error {
+	w.auctionFlushMu.Lock()
+	defer w.auctionFlushMu.Unlock()
+
+	w.journalMu.Lock()
+	auctions := make(map[string][]AuctionWinner, len(w.auctions))
+	for id, winners := range w.auctions {
+		auctions[id] = winners
+	}
+	w.journalMu.Unlock()
+	if len(auctions) == 0 {
+		return nil
+	}
+
+	if err := w.events.InsertAuctions(auctions); err != nil {
+		return err
+	}
+	w.journalMu.Lock()
+	for id := range auctions {
+		delete(w.auctions, id)
+	}
+	w.journalMu.Unlock()
+	return nil
+}
+
+/*
+make sure an auction is in the store before an event on it is recorded:
+an auction still pending is inserted with every other pending one, not waiting for the flush interval
+*/
+func (w *spendWriter) flushAuction(auctionID string) error {
+	w.journalMu.Lock()
+	_, pending := w.auctions[auctionID]
+	w.journalMu.Unlock()
+	if !pending {
+		return nil
+	}
+	return w.flushAuctions()
+}
+
+/*
+read the charges and the auctions of a batch file
+the last line cut short by a crash is skipped,
+a charge journaled without its time (before charged_at was journaled) takes the time the file was last written
+return:
+	charges, auction_id ==> winners, nil
+	a damaged line before the last one: every line that could be read, "Damaged spend batch"
+*/
+func readSpendBatch(path string) ([]SpendCharge, map[string][]AuctionWinner, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, errors.New("Failed to read spend batch " + path)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, errors.New("Failed to read spend batch " + path)
+	}
+
+	var charges []SpendCharge
+	auctions := map[string][]AuctionWinner{}
+	damaged := ""
+	corrupt := false
+	scanner := bufio.NewScanner(file)
+	// an auction line holds every winner of the auction
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		if damaged != "" {
+			log.Printf("Damaged line in the middle of spend batch %s: %q\n", path, damaged)
+			corrupt = true
+		}
+		damaged = ""
+		var auction journaledAuction
+		if err := json.Unmarshal(scanner.Bytes(), &auction); err != nil {
+			damaged = scanner.Text()
+			continue
+		}
+		if auction.AuctionID != "" {
+			auctions[auction.AuctionID] = auction.Winners
+			continue
+		}
+		var charge SpendCharge
+		json.Unmarshal(scanner.Bytes(), &charge)
+		if charge.ChargedAt.IsZero() {
+			charge.ChargedAt = info.ModTime()
+		}
+		// days start at local midnight, like the daily budgets
+		charge.ChargedAt = charge.ChargedAt.Local()
+		charges = append(charges, charge)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, errors.New("Failed to read spend batch " + path)
+	}
+	if damaged != "" {
+		log.Printf("Skipping damaged last line of spend batch %s: %q\n", path, damaged)
+	}
+	if corrupt {
+		return charges, auctions, errors.New("Damaged spend batch")
+	}
+	return charges, auctions, nil
+}
+
+/*
+sum the charges per advertiser, campaign, ad and day they were made: one ledger entry each,
+charged at the time of its last charge
+*/
+func aggregateSpend(charges []SpendCharge) []SpendCharge {
+	totals := map[SpendCharge]Money{}
+	last := map[SpendCharge]time.Time{}
+	var keys []SpendCharge
+	for _, c := range charges {
+		key := SpendCharge{AdvertiserID: c.AdvertiserID, CampaignID: c.CampaignID, AdID: c.AdID, ChargedAt: startOfDay(c.ChargedAt)}
+		if _, ok := totals[key]; !ok {
+			keys = append(keys, key)
+		}
+		totals[key] += c.Amount
+		if c.ChargedAt.After(last[key]) {
+			last[key] = c.ChargedAt
+		}
+	}
+	aggregated := make([]SpendCharge, len(keys))
+	for i, key := range keys {
+		aggregated[i] = key
+		aggregated[i].Amount, aggregated[i].ChargedAt = totals[key], last[key]
+	}
+	return aggregated
+}
+
+// flush id of "<journal>.<flush id>.batch"
+func (w *spendWriter) flushID(batch string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(batch, w.path+"."), ".batch")
+}
+
+// when a batch that failed to apply is tried again
+type batchRetry struct {
+	failures int
+	next     time.Time
+}
+
+// backoff between the retries of a batch: doubles from spendRetryMin up to spendRetryMax
+const (
+	spendRetryMin = time.Second
+	spendRetryMax = 5 * time.Minute
+)
+
+/*
+start a new journal, insert the pending auctions and apply every batch to the store, oldest first
+a batch that fails is retried by a later flush, once its backoff is over
+*/
+func (w *spendWriter) flush() error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	w.journalMu.Lock()
+	if w.journaled > 0 {
+		w.journal.Close()
+		err := w.rotate()
+		journal, openErr := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if openErr != nil {
+			w.journalMu.Unlock()
+			return errors.New("Failed to open spend journal " + w.path)
+		}
+		w.journal = journal
+		if err != nil {
+			w.journalMu.Unlock()
+			return err
+		}
+		w.journaled = 0
+	}
+	w.journalMu.Unlock()
+
+	// the winners go in before the batches journaling them are removed
+	if err := w.flushAuctions(); err != nil {
+		return err
+	}
+
+	batches, err := w.batchFiles()
+	if err != nil {
+		return err
+	}
+	// the store applies a flush id once: retrying a batch, in any order, never charges it twice
+	var flushErr error
+	now := time.Now()
+	for _, batch := range batches {
+		if retry, ok := w.retries[batch]; ok && now.Before(retry.next) {
+			continue
+		}
+		charges, err := w.applyBatch(batch)
+		if err != nil && err.Error() == "Damaged spend batch" {
+			delete(w.retries, batch)
+			w.quarantine(batch)
+			flushErr = err
+			continue
+		}
+		if err != nil {
+			retry := w.retries[batch]
+			retry.failures++
+			backoff := spendRetryMin
+			for i := 1; i < retry.failures && backoff < spendRetryMax; i++ {
+				backoff *= 2
+			}
+			if backoff > spendRetryMax {
+				backoff = spendRetryMax
+			}
+			retry.next = now.Add(backoff)
+			w.retries[batch] = retry
+			log.Printf("Failed to apply spend batch %s (attempt %d, retrying in %v): %v\n", batch, retry.failures, backoff, err)
+			flushErr = err
+			continue
+		}
+		delete(w.retries, batch)
+		w.mu.Lock()
+		w.addUnflushed(charges, -1)
+		w.mu.Unlock()
+	}
+	return flushErr
+}
+
+/*
+apply one batch file to the store and remove it
+*/
+func (w *spendWriter) applyBatch(batch string) ([]SpendCharge, error) {
+	charges, _, err := readSpendBatch(batch)
+	if err != nil {
+		return nil, err
+	}
+	if err = w.store.ApplySpend(w.flushID(batch), aggregateSpend(charges)); err != nil {
+		return nil, err
+	}
+	if err = os.Remove(batch); err != nil {
+		return nil, errors.New("Failed to remove spend batch " + batch)
+	}
+	return charges, nil
+}
+
+/*
+set a batch that cannot be decoded aside as "<batch>.failed", for an operator to repair or apply by hand
+its charges stay pending, and keep the budgets they took, until the file is removed and the server restarted
+*/
+func (w *spendWriter) quarantine(batch string) {
+	charges, _, _ := readSpendBatch(batch)
+	if err := os.Rename(batch, batch+".failed"); err != nil {
+		log.Println("Failed to quarantine spend batch", batch+":", err)
+		return
+	}
+	log.Printf("Quarantined spend batch %s: %d readable charges not applied\n", batch+".failed", len(charges))
+}
+
+/*
+flush every "interval", until the process exits
+*/
+func (w *spendWriter) runFlusher(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := w.flush(); err != nil {
+			log.Println("Failed to flush spend:", err)
+		}
+	}
+}
+
+/*
+apply a batch of charges in one transaction, at most once per flush id
+a charge larger than the remaining budget (spend by another server since the catalog was loaded)
+takes the budget to zero and is logged as overspend
+a charge on a campaign deleted since the auction debits the advertiser only,
+a charge on an advertiser that no longer exists is dropped: both are logged, neither fails the batch
+*/
+func (store *mysqlStore) ApplySpend(flushID string, charges []SpendCharge) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return errors.New("Failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	// already applied before a crash
+	var applied int
+	if err = tx.QueryRow("SELECT COUNT(*) FROM spend_flush WHERE flush_id = ?", flushID).Scan(&applied); err != nil {
+		return errors.New("Failed to select from spend_flush table")
+	}
+	if applied > 0 {
+		return nil
+	}
+	if _, err = tx.Exec("INSERT INTO spend_flush (flush_id) VALUES (?)", flushID); err != nil {
+		return errors.New("Failed to insert into spend_flush table")
+	}
+
+	for _, c := range charges {
+		var nilBudget sql.NullInt64
+		err = tx.Stmt(store.lockBudgetStmt).QueryRow(c.AdvertiserID).Scan(&nilBudget)
+		if err == sql.ErrNoRows {
+			log.Printf("Dropping charge of %s on ad %d: advertiser %d not found\n", c.Amount, c.AdID, c.AdvertiserID)
+			continue
+		}
+		if err != nil {
+			return errors.New("Failed to get old budget")
+		}
+		debit := spendDebit(Money(nilBudget.Int64), c)
+		newBudget := Money(nilBudget.Int64) - debit
+		if _, err = tx.Stmt(store.updateBudgetStmt).Exec(newBudget, c.AdvertiserID); err != nil {
+			return errors.New("Failed to update budget")
+		}
+
+		if c.CampaignID != 0 {
+			var campaignBudget int64
+			err = tx.Stmt(store.lockCampaignBudgetStmt).QueryRow(c.CampaignID).Scan(&campaignBudget)
+			if err == sql.ErrNoRows {
+				log.Printf("Charging %s on ad %d to advertiser %d only: campaign %d not found\n", c.Amount, c.AdID, c.AdvertiserID, c.CampaignID)
+			} else if err != nil {
+				return errors.New("Failed to get old budget")
+			} else {
+				newCampaignBudget := Money(campaignBudget) - spendDebit(Money(campaignBudget), c)
+				if _, err = tx.Stmt(store.updateCampaignBudgetStmt).Exec(newCampaignBudget, c.CampaignID); err != nil {
+					return errors.New("Failed to update budget")
+				}
+			}
+		}
+
+		if _, err = tx.Stmt(store.insertChargeStmt).Exec(c.AdvertiserID, transactionAuctionCharge, -debit, nullID(c.AdID), nullID(c.CampaignID), newBudget, c.ChargedAt); err != nil {
+			return errors.New("Failed to insert into budget_transaction table")
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errors.New("Failed to commit transaction")
+	}
+	return nil
+}
+
+/*
+the part of a charge a budget can still pay: never takes the budget below zero
+*/
+func spendDebit(budget Money, c SpendCharge) Money {
+	if budget < 0 {
+		budget = 0
+	}
+	if c.Amount > budget {
+		log.Printf("Overspend: advertiser %d campaign %d ad %d charged %s with %s left\n", c.AdvertiserID, c.CampaignID, c.AdID, c.Amount, budget)
+		return budget
+	}
+	return c.Amount
+}
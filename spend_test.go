@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSpendJournalReplay(t *testing.T) {
+	charges := `{"advertiser_id":1,"ad_id":1,"amount":0.5}
+{"auction_id":"a1","winners":[{"auction_id":"a1","position":1,"price":0.5,"ad":{"ad_id":1,"advertiser_id":1,"billing_model":"cpc"}}]}
+{"advertiser_id":1,"ad_id":1,"amount":0.25}
+{"advertiser_id":1,"ad_id":2,"amo`
+
+	tests := []struct {
+		name string
+		// file left by the previous process, relative to the journal
+		file string
+		// the batch was applied to the store before the crash
+		applied bool
+	}{
+		{"journal", "", false},
+		{"batch not applied", ".20260101T000000.000000000-a.batch", false},
+		{"batch applied before the crash", ".20260101T000000.000000000-a.batch", true},
+	}
+	for _, tt := range tests {
+		dir, err := ioutil.TempDir("", "spend")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "spend.journal")
+		if err = ioutil.WriteFile(path+tt.file, []byte(charges), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		store := newMemoryStore()
+		store.InsertAdvertiser(Advertiser{Name: "a", Budget: 10 * microsPerUnit})
+		if tt.applied {
+			store.ApplySpend("20260101T000000.000000000-a", []SpendCharge{{AdvertiserID: 1, AdID: 1, Amount: 750000}})
+		}
+
+		w, err := newSpendWriter(path, store, store)
+		if err != nil {
+			t.Fatalf("%s: newSpendWriter: %v", tt.name, err)
+		}
+		// the damaged last line is skipped
+		if pending, _ := w.pending(); pending[1] != 750000 {
+			t.Errorf("%s: pending = %s, want 0.75", tt.name, pending[1])
+		}
+		if err = w.flush(); err != nil {
+			t.Fatalf("%s: flush: %v", tt.name, err)
+		}
+		// flushing again applies nothing twice
+		if err = w.flush(); err != nil {
+			t.Fatalf("%s: second flush: %v", tt.name, err)
+		}
+
+		if pending, _ := w.pending(); pending[1] != 0 {
+			t.Errorf("%s: pending after flush = %s, want 0", tt.name, pending[1])
+		}
+		// debited once, in one ledger entry
+		budgets, _ := store.SelectAdvertiserBudgets()
+		if budgets[1] != 9250000 {
+			t.Errorf("%s: budget = %s, want 9.25", tt.name, budgets[1])
+		}
+		if transactions, _ := store.SelectBudgetTransactions(1, time.Time{}, time.Time{}); len(transactions) != 1 {
+			t.Errorf("%s: %d ledger entries, want 1", tt.name, len(transactions))
+		}
+		if winners, err := store.SelectAuction("a1"); err != nil || len(winners) != 1 || winners[0].Ad.AdID != 1 {
+			t.Errorf("%s: auction a1 = %v, %v, want ad 1", tt.name, winners, err)
+		}
+		if batches, _ := w.batchFiles(); len(batches) != 0 {
+			t.Errorf("%s: batches left = %v", tt.name, batches)
+		}
+		w.journal.Close()
+	}
+}
+
+// memoryStore whose next "failures" ApplySpend calls fail like a dropped connection
+type flakySpendStore struct {
+	*memoryStore
+	failures int
+}
+
+func (store *flakySpendStore) ApplySpend(flushID string, charges []SpendCharge) error {
+	if store.failures > 0 {
+		store.failures--
+		return errors.New("Failed to commit transaction")
+	}
+	return store.memoryStore.ApplySpend(flushID, charges)
+}
+
+func TestSpendFlushRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spend.journal")
+	journal := `{"advertiser_id":1,"ad_id":1,"amount":0.5}
+{"advertiser_id":1,"ad_id":1,"amo
+{"advertiser_id":1,"ad_id":1,"amount":0.25}
+`
+	if err = ioutil.WriteFile(path+".20260101T000000.000000000-a.batch", []byte(`{"advertiser_id":1,"ad_id":1,"amount":1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path+".20260101T000001.000000000-b.batch", []byte(journal), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	memory := newMemoryStore()
+	memory.InsertAdvertiser(Advertiser{Name: "a", Budget: 10 * microsPerUnit})
+	store := &flakySpendStore{memoryStore: memory, failures: 1}
+	w, err := newSpendWriter(path, store, memory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.journal.Close()
+
+	// batch a fails once, batch b is damaged in the middle: both stay pending
+	if err = w.flush(); err == nil {
+		t.Fatal("flush succeeded with a failing store")
+	}
+	if pending, _ := w.pending(); pending[1] != 1750000 {
+		t.Errorf("pending after the failed flush = %s, want 1.75", pending[1])
+	}
+	if _, err = os.Stat(path + ".20260101T000001.000000000-b.batch.failed"); err != nil {
+		t.Errorf("damaged batch not quarantined: %v", err)
+	}
+
+	// batch a waits for its backoff, then is applied
+	if err = w.flush(); err != nil {
+		t.Fatalf("flush during the backoff: %v", err)
+	}
+	if budgets, _ := memory.SelectAdvertiserBudgets(); budgets[1] != 10*microsPerUnit {
+		t.Errorf("budget during the backoff = %s, want 10", budgets[1])
+	}
+	for batch := range w.retries {
+		w.retries[batch] = batchRetry{failures: 1}
+	}
+	if err = w.flush(); err != nil {
+		t.Fatalf("flush after the backoff: %v", err)
+	}
+	if budgets, _ := memory.SelectAdvertiserBudgets(); budgets[1] != 9*microsPerUnit {
+		t.Errorf("budget after the retry = %s, want 9", budgets[1])
+	}
+
+	// the quarantined batch is still pending, after a restart as well
+	if pending, _ := w.pending(); pending[1] != 750000 {
+		t.Errorf("pending after the retry = %s, want 0.75", pending[1])
+	}
+	restarted, err := newSpendWriter(path, store, memory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.journal.Close()
+	if pending, _ := restarted.pending(); pending[1] != 750000 {
+		t.Errorf("pending after a restart = %s, want 0.75", pending[1])
+	}
+}
+
+func TestAggregateSpendByDay(t *testing.T) {
+	day := time.Date(2026, 1, 1, 0, 0, 0, 0, time.Local)
+	charges := []SpendCharge{
+		{AdvertiserID: 1, AdID: 1, Amount: 100, ChargedAt: day.Add(-time.Minute)},
+		{AdvertiserID: 1, AdID: 1, Amount: 200, ChargedAt: day.Add(time.Minute)},
+		{AdvertiserID: 1, AdID: 1, Amount: 300, ChargedAt: day.Add(2 * time.Minute)},
+	}
+
+	aggregated := aggregateSpend(charges)
+	// a charge before midnight stays out of the next day's entry
+	if len(aggregated) != 2 {
+		t.Fatalf("aggregated = %v, want one entry per day", aggregated)
+	}
+	if aggregated[0].Amount != 100 || !aggregated[0].ChargedAt.Equal(day.Add(-time.Minute)) {
+		t.Errorf("first day = %v, want 100 charged at %v", aggregated[0], day.Add(-time.Minute))
+	}
+	if aggregated[1].Amount != 500 || !aggregated[1].ChargedAt.Equal(day.Add(2*time.Minute)) {
+		t.Errorf("second day = %v, want 500 charged at the last charge %v", aggregated[1], day.Add(2*time.Minute))
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// AdStore keeps the ads
+type AdStore interface {
+	InsertAd(ad Ad) error
+	SelectAd(adID int) (Ad, error)
+	// only the ads in status active: the auction candidates
+	SelectActiveAds() ([]Ad, error)
+	SelectAdsByAdvertiserID(id int) ([]Ad, error)
+	DeleteAd(adID int) error
+	// move the ad from status "from" to "to"; false, nil when it is no longer in "from"
+	SetAdStatus(adID int, from, to string) (bool, error)
+	SelectAdsByStatus(status string) ([]Ad, error)
+	// record the decision and move the ad out of pending_review; false, nil when it is no longer pending
+	ReviewAd(review AdReview) (bool, error)
+	SelectAdReviews(adID int) ([]AdReview, error)
+	// ad_id ==> adscore learned from the event history
+	UpdateAdScores(scores map[int]float64) error
+}
+
+// AdvertiserStore keeps the advertisers, their budgets and the budget ledger
+type AdvertiserStore interface {
+	InsertAdvertiser(advertiser Advertiser) error
+	SearchAdvertiser(name string) (Advertiser, error)
+	SelectAdvertiserBudgets() (map[int]Money, error)
+	// add "amount" (negative for a debit) to a budget, never going below zero
+	// returns false, nil when the budget is too small
+	// campaignID 0: the advertiser budget only, else the campaign budget as well
+	ChangeBudget(advertiserID int, campaignID int, amount Money, txType string, adID int) (bool, error)
+	SelectBudgetTransactions(advertiserID int, from, to time.Time) ([]BudgetTransaction, error)
+	// debit a batch of auction charges in one go; a flush id already applied is skipped
+	ApplySpend(flushID string, charges []SpendCharge) error
+	SetDailyBudget(advertiserID int, amount Money, pacing string) error
+	// advertiser_id ==> daily budget, only the advertisers with one
+	SelectDailyBudgets() (map[int]dailyBudget, error)
+	// auction charges since "since": advertiser_id ==> spend, campaign_id ==> spend
+	SelectSpendSince(since time.Time) (map[int]Money, map[int]Money, error)
+}
+
+// EventStore keeps the auction winners and the impression / click / conversion events on them
+type EventStore interface {
+	// auction_id ==> winners; a winner already recorded is left as it is
+	InsertAuctions(auctions map[string][]AuctionWinner) error
+	// "Auction not found" when no winner was recorded under auctionID
+	SelectAuction(auctionID string) ([]AuctionWinner, error)
+	// mark the winner of the auction showing adID as charged for its billing event
+	// returns false, nil when it already was: the caller must not charge it again
+	MarkCharged(auctionID string, adID int) (bool, error)
+	// undo MarkCharged when the billing event could not be recorded or charged, so a retry is billed
+	ClearCharged(auctionID string, adID int) error
+	// at most one event of each type per auction winner: returns false, nil for a repeat
+	InsertEvent(event AdEvent) (bool, error)
+	SelectAdStats(adID int) (AdStats, error)
+	// ad_id ==> stats of every ad with events
+	SelectAllAdStats() (map[int]AdStats, error)
+}
+
+// CampaignStore keeps the campaigns and their ad groups
+type CampaignStore interface {
+	InsertCampaign(campaign Campaign) (int, error)
+	UpdateCampaign(campaign Campaign) error
+	DeleteCampaign(campaignID int) error
+	SelectCampaign(campaignID int) (Campaign, error)
+	// advertiserID 0: every campaign
+	SelectCampaigns(advertiserID int) ([]Campaign, error)
+	InsertAdGroup(group AdGroup) (int, error)
+	UpdateAdGroup(group AdGroup) error
+	DeleteAdGroup(adGroupID int) error
+	SelectAdGroup(adGroupID int) (AdGroup, error)
+	// campaignID 0: every ad group
+	SelectAdGroups(campaignID int) ([]AdGroup, error)
+}
+
+// DBPoolConfig type: limits of the shared MySQL connection pool
+type DBPoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// mysqlStore keeps everything in MySQL through one pool shared by all handlers
+type mysqlStore struct {
+	db *sql.DB
+
+	// prepared statements of the /chooseAd(s) hot path
+	selectActiveAdsStmt      *sql.Stmt
+	selectBudgetsStmt        *sql.Stmt
+	lockBudgetStmt           *sql.Stmt
+	updateBudgetStmt         *sql.Stmt
+	insertLedgerStmt         *sql.Stmt
+	insertChargeStmt         *sql.Stmt
+	selectAdGroupsStmt       *sql.Stmt
+	selectCampaignsStmt      *sql.Stmt
+	lockCampaignBudgetStmt   *sql.Stmt
+	updateCampaignBudgetStmt *sql.Stmt
+}
+
+/*
+open the connection pool and prepare the hot statements
+called once at startup
+*/
+func newMySQLStore(dsn string, pool DBPoolConfig) (*mysqlStore, error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, errors.New("Failed to connect the database")
+	}
+	db.SetMaxOpenConns(pool.MaxOpenConns)
+	db.SetMaxIdleConns(pool.MaxIdleConns)
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+
+	store := &mysqlStore{db: db}
+	statements := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&store.selectActiveAdsStmt, "SELECT " + adColumns + " FROM ad WHERE status = '" + adStatusActive + "'"},
+		{&store.selectBudgetsStmt, "SELECT advertiser_id, budget FROM advertiser"},
+		{&store.lockBudgetStmt, "SELECT budget FROM advertiser WHERE advertiser_id = ? FOR UPDATE"},
+		{&store.updateBudgetStmt, "UPDATE advertiser SET budget = ? WHERE advertiser_id = ?"},
+		{&store.insertLedgerStmt, "INSERT INTO budget_transaction (advertiser_id, type, amount, ad_id, campaign_id, balance_after) VALUES (?, ?, ?, ?, ?, ?)"},
+		{&store.insertChargeStmt, "INSERT INTO budget_transaction (advertiser_id, type, amount, ad_id, campaign_id, balance_after, charged_at) VALUES (?, ?, ?, ?, ?, ?, ?)"},
+		{&store.selectAdGroupsStmt, "SELECT " + adGroupColumns + " FROM ad_group"},
+		{&store.selectCampaignsStmt, "SELECT " + campaignColumns + " FROM campaign"},
+		{&store.lockCampaignBudgetStmt, "SELECT budget FROM campaign WHERE campaign_id = ? FOR UPDATE"},
+		{&store.updateCampaignBudgetStmt, "UPDATE campaign SET budget = ? WHERE campaign_id = ?"},
+	}
+	for _, s := range statements {
+		if *s.stmt, err = db.Prepare(s.query); err != nil {
+			store.Close()
+			return nil, errors.New("Failed to prepare statement: " + s.query)
+		}
+	}
+	return store, nil
+}
+
+/*
+close the prepared statements and the pool
+*/
+func (store *mysqlStore) Close() error {
+	for _, stmt := range []*sql.Stmt{store.selectActiveAdsStmt, store.selectBudgetsStmt, store.lockBudgetStmt, store.updateBudgetStmt, store.insertLedgerStmt,
+		store.insertChargeStmt, store.selectAdGroupsStmt, store.selectCampaignsStmt, store.lockCampaignBudgetStmt, store.updateCampaignBudgetStmt} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	return store.db.Close()
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RequestContext type: what is known about the impression being auctioned
+// read from the query string of /chooseAd and /chooseAds
+type RequestContext struct {
+	// country code, e.g. "us"
+	Geo string `json:"geo,omitempty"`
+	// desktop, mobile, tablet, ...
+	Device   string `json:"device,omitempty"`
+	Language string `json:"language,omitempty"`
+	// keywords and category of the page
+	Keywords []string `json:"keywords,omitempty"`
+	Category string   `json:"category,omitempty"`
+	// hour of the day (0-23) at the viewer
+	Hour int `json:"hour"`
+}
+
+// AuctionRequest type: one auction for "Slots" positions on "Placement"
+type AuctionRequest struct {
+	Placement string
+	Slots     int
+	// viewer, for frequency capping; empty: anonymous
+	UserID  string
+	Context RequestContext
+}
+
+/*
+read the auction request from the query string:
+	?placement= &user_id= &geo= &device= &lang= &keywords=a,b &category= &hour=
+the hour defaults to the current UTC hour
+*/
+func parseAuctionRequest(query url.Values, slots int, now time.Time) (AuctionRequest, error) {
+	request := AuctionRequest{
+		Placement: query.Get("placement"),
+		Slots:     slots,
+		UserID:    query.Get("user_id"),
+		Context: RequestContext{
+			Geo:      normalizeTerm(query.Get("geo")),
+			Device:   normalizeTerm(query.Get("device")),
+			Language: normalizeTerm(query.Get("lang")),
+			Keywords: normalizeTerms(strings.Split(query.Get("keywords"), ",")),
+			Category: normalizeTerm(query.Get("category")),
+			Hour:     now.UTC().Hour(),
+		},
+	}
+	if h := query.Get("hour"); h != "" {
+		hour, err := strconv.Atoi(h)
+		if err != nil || hour < 0 || hour > 23 {
+			return request, errors.New("hour must be an integer from 0 to 23")
+		}
+		request.Context.Hour = hour
+	}
+	return request, nil
+}
+
+// targeting values are compared case-insensitively
+func normalizeTerm(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+func normalizeTerms(terms []string) []string {
+	var normalized []string
+	for _, term := range terms {
+		if term = normalizeTerm(term); term != "" {
+			normalized = append(normalized, term)
+		}
+	}
+	return normalized
+}
+
+func containsTerm(terms []string, term string) bool {
+	for _, t := range terms {
+		if t == term {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+whether a request value passes an include and an exclude list
+an empty include list takes any value; a non-empty one needs the request to carry a listed value
+*/
+func matchList(include, exclude []string, value string) bool {
+	if len(include) > 0 && !containsTerm(include, value) {
+		return false
+	}
+	return value == "" || !containsTerm(exclude, value)
+}
+
+/*
+same for the page keywords: one keyword in the include list is enough, one in the exclude list is too many
+*/
+func matchKeywords(include, exclude []string, keywords []string) bool {
+	if len(include) > 0 {
+		found := false
+		for _, keyword := range keywords {
+			if containsTerm(include, keyword) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, keyword := range keywords {
+		if containsTerm(exclude, keyword) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+whether the targeting rules accept the request context (nil rules accept everything)
+*/
+func (t *Targeting) matches(ctx RequestContext) bool {
+	if t == nil {
+		return true
+	}
+	if len(t.Hours) > 0 {
+		found := false
+		for _, hour := range t.Hours {
+			if hour == ctx.Hour {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return matchList(t.Geos, t.ExcludeGeos, ctx.Geo) &&
+		matchList(t.Devices, t.ExcludeDevices, ctx.Device) &&
+		matchList(t.Languages, t.ExcludeLanguages, ctx.Language) &&
+		matchList(t.Categories, t.ExcludeCategories, ctx.Category) &&
+		matchKeywords(t.Keywords, t.ExcludeKeywords, ctx.Keywords)
+}
+
+/*
+lower-case the rule values and check the hours
+*/
+func (t *Targeting) normalize() error {
+	if t == nil {
+		return nil
+	}
+	for _, list := range []*[]string{&t.Geos, &t.ExcludeGeos, &t.Devices, &t.ExcludeDevices, &t.Languages, &t.ExcludeLanguages,
+		&t.Keywords, &t.ExcludeKeywords, &t.Categories, &t.ExcludeCategories} {
+		*list = normalizeTerms(*list)
+	}
+	for _, hour := range t.Hours {
+		if hour < 0 || hour > 23 {
+			return errors.New("Targeting hours must be from 0 to 23")
+		}
+	}
+	return nil
+}
+
+/*
+keep the ads whose own targeting and whose campaign's targeting accept the request context
+*/
+func filterTargeting(ads []Ad, campaignByID map[int]Campaign, ctx RequestContext) []Ad {
+	var matching []Ad
+	for _, ad := range ads {
+		if ad.Targeting.matches(ctx) && campaignByID[ad.CampaignID].Targeting.matches(ctx) {
+			matching = append(matching, ad)
+		}
+	}
+	return matching
+}
+
+/*
+the targeting rules stored as a JSON text column (NULL: no rules)
+*/
+func targetingColumn(t *Targeting) sql.NullString {
+	if t == nil {
+		return sql.NullString{}
+	}
+	content, _ := json.Marshal(t)
+	return sql.NullString{String: string(content), Valid: true}
+}
+
+func targetingFromColumn(column sql.NullString) (*Targeting, error) {
+	if !column.Valid || column.String == "" {
+		return nil, nil
+	}
+	var t Targeting
+	if err := json.Unmarshal([]byte(column.String), &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}